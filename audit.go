@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/audit"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/Brickchain/hass-proxy/pkg/policy"
+	"github.com/spf13/viper"
+)
+
+// newAuditLog returns the audit log from the audit settings, or nil if audit_file is not set
+func newAuditLog() *audit.Log {
+	file := viper.GetString("audit_file")
+	if file == "" {
+		return nil
+	}
+
+	return audit.NewLog(file, viper.GetInt64("audit_max_size")*1024*1024, viper.GetDuration("audit_max_age"),
+		viper.GetInt("audit_keep"))
+}
+
+// auditMandates records who made a request, from the mandates it was authorized with
+func auditMandates(record *audit.Record, mandates []httphandler.AuthenticatedMandate) {
+	record.Signer = signerOf(mandates)
+	for _, mandate := range mandates {
+		record.Mandates = append(record.Mandates, audit.Mandate{
+			Role:     mandate.Mandate.Role,
+			RoleName: mandate.Mandate.RoleName,
+		})
+	}
+}
+
+// auditPath records the service or entity that a request is for, as told by its path
+func auditPath(record *audit.Record, r *http.Request) {
+	path := policy.CleanPath(r.URL.Path)
+
+	if id, ok := hass.EntityFromPath(path); ok {
+		record.Entities = []string{id}
+	}
+
+	if domain, service, ok := hass.ServiceFromPath(path); ok {
+		record.Domain = domain
+		record.Service = service
+	}
+}
+
+// auditServiceCall records the entities that an authorized service call targets. The body is read and put back on
+// the request, and false is returned if it can't be read.
+func auditServiceCall(w http.ResponseWriter, r *http.Request, record *audit.Record) bool {
+	if !hass.IsServiceCall(r.Method, policy.CleanPath(r.URL.Path)) {
+		return true
+	}
+
+	body, ok := readServiceBody(w, r)
+	if !ok {
+		return false
+	}
+
+	record.Entities = hass.ServiceBodyEntities(body)
+
+	return true
+}
+
+// auditCommand writes a record for a call_service command sent on a websocket session to the audit log, with who the
+// session belongs to and the service and entities the command is for. Commands that were refused are recorded as
+// forbidden.
+func (h *httpClient) auditCommand(session *audit.Record, msg []byte, relayed bool) {
+	cmd, err := hass.ParseCommand(msg)
+	if err != nil || cmd.Type != "call_service" {
+		return
+	}
+
+	record := audit.Record{
+		Time:     time.Now().UTC(),
+		Signer:   session.Signer,
+		Mandates: session.Mandates,
+		Method:   session.Method,
+		Path:     session.Path,
+		Command:  cmd.Type,
+		Domain:   cmd.Domain,
+		Service:  cmd.Service,
+		Entities: hass.CommandEntities(cmd),
+	}
+	if !relayed {
+		record.Status = http.StatusForbidden
+	}
+
+	if err := h.audit.Write(record); err != nil {
+		logger.Error(err)
+	}
+}
+
+// writeAudit finishes a record with the response and writes it to the audit log
+func (h *httpClient) writeAudit(record *audit.Record, w *statusWriter, latency time.Duration) {
+	record.Status = w.status
+	if record.Status == 0 {
+		record.Status = http.StatusOK
+	}
+	record.LatencyMS = float64(latency) / float64(time.Millisecond)
+	record.Bytes = w.bytes
+
+	if err := h.audit.Write(*record); err != nil {
+		logger.Error(err)
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/go-proxy.v1/pkg/client"
+	"github.com/Brickchain/hass-proxy/pkg/audit"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+	"github.com/Brickchain/hass-proxy/pkg/controller"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// command is a subcommand of hass-proxy
+type command struct {
+	name        string
+	args        string
+	description string
+	run         func(args []string) int
+}
+
+// commands are listed in the order they are shown in the usage, run is used if no command is given
+var commands = []command{
+	{"run", "", "Connect the tunnel and serve requests (default)", runProxy},
+	{"check-config", "", "Validate the configuration without connecting anywhere", checkConfig},
+	{"keygen", "", "Create the key file for the tunnel", keygen},
+	{"pubkey", "", "Print the public key and thumbprint of the tunnel key", pubkey},
+	{"rotate-key", "", "Replace the tunnel key with a new one and register it", rotateKey},
+	{"register", "", "Register to the controller and print the realm key and roles", register},
+	{"verify-token", "<mandate token>", "Verify a mandate token and explain the decision", verifyToken},
+	{"audit", "", "Print the records in the audit log that match the filters", auditCommand},
+	{"add-user", "", "Map a realm user to a Home Assistant user", addUser},
+	{"list-users", "", "List the realm users that are mapped to Home Assistant users", listUsers},
+	{"remove-user", "", "Remove the mapping of a realm user", removeUser},
+	{"version", "", "Print the version", version},
+}
+
+// settings that can be given as flags to every command, which take precedence over all other configuration
+var flagSettings = []struct {
+	setting string
+	usage   string
+}{
+	{"config_file", "config file to read settings from"},
+	{"options_file", "Hass.io add-on options file"},
+	{"key", "file with the private key of the tunnel"},
+	{"log_level", "log level"},
+	{"log_formatter", "log format, text or json"},
+	{"remote", "URL of the controller"},
+	{"proxy_endpoint", "URL of the proxy"},
+	{"local", "URL of Home Assistant"},
+	{"policy_file", "file with the access policy for the mandate roles"},
+}
+
+// runCommand runs the command given in args and returns the exit status
+func runCommand(args []string) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return 0
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+
+	return 2
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: hass-proxy [command] [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun hass-proxy <command> --help for the flags of a command.\n")
+}
+
+// newFlagSet returns the flag set for a command, with the flags for the settings
+func newFlagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("hass-proxy "+name, pflag.ContinueOnError)
+	for _, f := range flagSettings {
+		fs.String(flagName(f.setting), "", f.usage)
+	}
+
+	return fs
+}
+
+// parseFlags parses the flags of a command and binds them to the settings, so that they take precedence once the
+// configuration is loaded. It returns the exit status to use if the command shouldn't run.
+func parseFlags(fs *pflag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0, false
+		}
+		return 2, false
+	}
+
+	for _, f := range flagSettings {
+		if err := viper.BindPFlag(f.setting, fs.Lookup(flagName(f.setting))); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1, false
+		}
+	}
+
+	return 0, true
+}
+
+func flagName(setting string) string {
+	return strings.Replace(setting, "_", "-", -1)
+}
+
+// loadConfig loads and validates the configuration for commands other than run and check-config
+func loadConfig() bool {
+	if err := config.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return false
+	}
+
+	setLogging()
+
+	if errs := config.Validate().Errors(); len(errs) > 0 {
+		for _, problem := range errs {
+			fmt.Fprintf(os.Stderr, "error: %s\n", problem)
+		}
+		return false
+	}
+
+	return true
+}
+
+// checkConfig validates the configuration and prints every problem, returning the exit status
+func checkConfig(args []string) int {
+	if status, ok := parseFlags(newFlagSet("check-config"), args); !ok {
+		return status
+	}
+
+	if err := config.Load(); err != nil {
+		fmt.Printf("error: %s\n", err)
+		return 1
+	}
+
+	problems := config.Validate()
+
+	for _, problem := range problems.Errors() {
+		fmt.Printf("error: %s\n", problem)
+	}
+
+	for _, problem := range problems.Warnings() {
+		fmt.Printf("warning: %s\n", problem)
+	}
+
+	if len(problems.Errors()) > 0 {
+		fmt.Printf("Configuration has %d error(s)\n", len(problems.Errors()))
+		return 1
+	}
+
+	fmt.Println("Configuration is valid")
+
+	return 0
+}
+
+// keygen creates the key file, which run otherwise does the first time it starts
+func keygen(args []string) int {
+	fs := newFlagSet("keygen")
+	force := fs.Bool("force", false, "replace the key file if it exists")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	file := viper.GetString("key")
+	if _, err := os.Stat(file); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "error: key file %s already exists, use --force to replace it\n", file)
+		return 1
+	}
+
+	key, err := createKey(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Created key %s with thumbprint %s\n", file, crypto.Thumbprint(key))
+
+	return 0
+}
+
+// pubkey prints the public part of the tunnel key
+func pubkey(args []string) int {
+	if status, ok := parseFlags(newFlagSet("pubkey"), args); !ok {
+		return status
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	key, err := readKey(viper.GetString("key"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	public, err := crypto.NewPublicKey(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	b, err := json.MarshalIndent(public, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(string(b))
+	fmt.Printf("Thumbprint: %s\n", crypto.Thumbprint(key))
+
+	return 0
+}
+
+// rotateKey creates a new key, registers it to the proxy and the controller, and then replaces the key file with it.
+// A running proxy picks up the new key file and moves its tunnel over to the new key, which retires the old one.
+func rotateKey(args []string) int {
+	if status, ok := parseFlags(newFlagSet("rotate-key"), args); !ok {
+		return status
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	credentials, err := newCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	// make sure that we can read the current key, so that we don't replace a key we were given the wrong passphrase for
+	file := viper.GetString("key")
+	old, err := readKey(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	key, err := crypto.NewKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	p, err := client.NewProxyClient(viper.GetString("proxy_endpoint"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	defer p.Disconnect()
+
+	hostname, err := p.Register(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to register the new key to the proxy: %s\n", err)
+		return 1
+	}
+
+	c := controller.NewController(viper.GetString("remote"), Version)
+	c.SetPinnedKeys(viper.GetString("controller_key"), viper.GetString("realm_key"))
+	c.SetCacheFile(config.RegistrationFile())
+
+	if err := c.Register(fmt.Sprintf("https://%s", hostname), credentials); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to register the new key to the controller: %s\n", err)
+		return 1
+	}
+
+	if err := writeKey(file, key); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Replaced key %s with %s\n", crypto.Thumbprint(old), crypto.Thumbprint(key))
+	fmt.Printf("Hostname: %s\n", hostname)
+
+	return 0
+}
+
+// register connects to the proxy to get our hostname, registers to the controller and prints what it sent back. A dry
+// run doesn't connect to the proxy, but registers with the hostname of the saved registration, which the running proxy
+// uses, and doesn't save what the controller sends back.
+func register(args []string) int {
+	fs := newFlagSet("register")
+	dryRun := fs.Bool("dry-run", false, "register with the hostname of the saved registration, without connecting to the proxy or saving the registration")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	credentials, err := newCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	c := controller.NewController(viper.GetString("remote"), Version)
+	c.SetPinnedKeys(viper.GetString("controller_key"), viper.GetString("realm_key"))
+	c.SetCacheFile(config.RegistrationFile())
+
+	var ourURL string
+	if *dryRun {
+		if err := c.LoadCache(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+
+		if ourURL = c.RegisteredURL(); ourURL == "" {
+			fmt.Fprintf(os.Stderr, "error: no saved registration to take the hostname from, run register without --dry-run first\n")
+			return 1
+		}
+
+		c.SetCacheFile("")
+	} else {
+		key, err := readKey(viper.GetString("key"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+
+		p, err := client.NewProxyClient(viper.GetString("proxy_endpoint"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+		defer p.Disconnect()
+
+		hostname, err := p.Register(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to register to the proxy: %s\n", err)
+			return 1
+		}
+
+		ourURL = fmt.Sprintf("https://%s", hostname)
+	}
+
+	if err := c.Register(ourURL, credentials); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Hostname: %s\n", strings.TrimPrefix(ourURL, "https://"))
+	fmt.Printf("Realm key: %s\n", crypto.Thumbprint(c.RealmKey()))
+	if c.Verified() {
+		fmt.Println("Verified: yes")
+	} else {
+		fmt.Println("Verified: no, set controller_key or realm_key to verify the controller")
+	}
+	fmt.Printf("Roles: %s\n", strings.Join(c.Roles(), ", "))
+
+	if *dryRun {
+		fmt.Println("Dry run, registered with the saved hostname but the registration was not saved")
+	}
+
+	return 0
+}
+
+// verifyToken checks a mandate token against the saved registration and explains why it is accepted or rejected
+func verifyToken(args []string) int {
+	fs := newFlagSet("verify-token")
+	audience := fs.String("audience", "", "hostname the token should be issued for, not checked if empty")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: hass-proxy verify-token <mandate token>\n")
+		return 2
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	revocations := controller.NewRevocations(config.RevocationURL(), config.RevocationFile())
+	if err := revocations.Load(); err != nil {
+		logger.Warn(err)
+	}
+
+	c := controller.NewController(viper.GetString("remote"), Version)
+	c.SetClockSkew(viper.GetDuration("token_clock_skew"))
+	c.SetRevocations(revocations)
+	c.SetPinnedKeys(viper.GetString("controller_key"), viper.GetString("realm_key"))
+	c.SetCacheFile(config.RegistrationFile())
+	if err := c.LoadCache(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	c.SetAudience(*audience)
+
+	// accept the token both with and without the "Mandate" auth scheme
+	token := strings.TrimSpace(fs.Arg(0))
+	if !strings.Contains(token, " ") {
+		token = "Mandate " + token
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", token)
+
+	result := c.Verify(req)
+	if result.Signer == nil {
+		fmt.Printf("Token is rejected: %s: %s\n", result.Reason, result.Err)
+		return 1
+	}
+
+	fmt.Printf("Signer: %s\n", crypto.Thumbprint(result.Signer))
+	fmt.Printf("URI: %s\n", result.URI)
+	fmt.Printf("Expires: %s\n", result.Expires.Format(time.RFC3339))
+
+	if result.Err != nil {
+		fmt.Printf("Token is rejected: %s: %s\n", result.Reason, result.Err)
+		return 1
+	}
+
+	for i, mandate := range result.Results {
+		if mandate.Accepted() {
+			fmt.Printf("Mandate %d (%s): accepted\n", i+1, mandate.Role)
+		} else {
+			fmt.Printf("Mandate %d (%s): rejected: %s: %s\n", i+1, mandate.Role, mandate.Reason, mandate.Err)
+		}
+	}
+
+	if !result.OK() {
+		fmt.Printf("Token is rejected: %s: none of the mandates are accepted\n", result.Reason)
+		return 1
+	}
+
+	fmt.Printf("Token is accepted with %d mandate(s): %s\n", len(result.Mandates), strings.Join(result.Roles(), ", "))
+
+	return 0
+}
+
+// auditCommand prints the records of the audit log that match the filters as JSON lines
+func auditCommand(args []string) int {
+	fs := newFlagSet("audit")
+	user := fs.String("user", "", "signer key thumbprint, or mandate role or role name")
+	entity := fs.String("entity", "", "entity ID")
+	since := fs.String("since", "", "only records from this time on, as RFC 3339, a date or a duration like 24h")
+	until := fs.String("until", "", "only records until this time, as RFC 3339, a date or a duration like 1h")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	if viper.GetString("audit_file") == "" {
+		fmt.Fprintf(os.Stderr, "error: audit_file is not set\n")
+		return 1
+	}
+
+	filter := audit.Filter{
+		User:   *user,
+		Entity: *entity,
+	}
+
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --since: %s\n", err)
+		return 2
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --until: %s\n", err)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	err = audit.Read(viper.GetString("audit_file"), viper.GetInt("audit_keep"), filter, func(record audit.Record) {
+		enc.Encode(record)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// parseTime parses a time given as RFC 3339, as a date, or as a duration back from now
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Time{}, errors.Errorf("can't parse %q as a time", s)
+}
+
+// version prints the version we're running
+func version(args []string) int {
+	fmt.Printf("hass-proxy %s\n", Version)
+	return 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Brickchain/hass-proxy/pkg/config"
+)
+
+// hop-by-hop headers are only meant for a single connection and must not be passed on by a proxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including any headers listed in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// copyHeader copies all values of every header from src to dst
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// localURL returns the Home Assistant URL for the path and query of the tunneled request
+func localURL(r *http.Request) (*url.URL, error) {
+	u, err := url.Parse(config.CurrentUpstream().URL)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+
+	return u, nil
+}
+
+// localHost returns the Host that should be used for requests to Home Assistant
+func localHost(u *url.URL) string {
+	if host := config.CurrentUpstream().Host; host != "" {
+		return host
+	}
+
+	return u.Host
+}
+
+// contentLength returns the length of the request body. The proxy client doesn't fill in ContentLength so we fall
+// back on the Content-Length header, and return 0 (unknown) if that isn't set either.
+func contentLength(r *http.Request) int64 {
+	if r.ContentLength > 0 {
+		return r.ContentLength
+	}
+
+	if l, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64); err == nil && l > 0 {
+		return l
+	}
+
+	return 0
+}
+
+// headers that tell a proxy where a request came from. The tunnel doesn't know the address of the remote client, so
+// these can only come from the client itself and can't be trusted.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// setForwardedHeaders replaces the forwarding headers sent by the client with the ones describing the tunneled
+// request, on the hostname of the tunnel. X-Forwarded-For is left out, since the tunnel doesn't tell us the address of
+// the remote client.
+//
+// The hostname is the one the proxy registered us with, and not the Host of the request, which the proxy client takes
+// from the X-Forwarded-Host header sent by the remote client.
+func setForwardedHeaders(h http.Header, host string) {
+	for _, header := range forwardedHeaders {
+		h.Del(header)
+	}
+
+	h.Set("X-Forwarded-Proto", "https")
+
+	if host != "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+}
+
+// rewriteLocation rewrites redirects that point at Home Assistant so that they point at the tunnel hostname instead
+func rewriteLocation(h http.Header, host string) {
+	location := h.Get("Location")
+	if location == "" || host == "" {
+		return
+	}
+
+	upstream := config.CurrentUpstream()
+	local, err := url.Parse(upstream.URL)
+	if err != nil {
+		return
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() {
+		return
+	}
+
+	if u.Host != local.Host && u.Host != upstream.Host {
+		return
+	}
+
+	u.Scheme = "https"
+	u.Host = host
+	u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, strings.TrimSuffix(local.Path, "/")), "/")
+
+	h.Set("Location", u.String())
+}
+
+// rewriteCookies rewrites the domain of cookies set for Home Assistant to the hostname of the tunnel
+func rewriteCookies(h http.Header, host string) {
+	cookies := h["Set-Cookie"]
+	if len(cookies) == 0 || host == "" {
+		return
+	}
+
+	upstream := config.CurrentUpstream()
+	local, err := url.Parse(upstream.URL)
+	if err != nil {
+		return
+	}
+
+	localHosts := []string{local.Hostname(), upstream.Host}
+	publicHost := host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		publicHost = hostname
+	}
+
+	rewritten := make([]string, 0, len(cookies))
+	for _, raw := range cookies {
+		res := http.Response{Header: http.Header{"Set-Cookie": {raw}}}
+		parsed := res.Cookies()
+		if len(parsed) != 1 || parsed[0].Domain == "" {
+			rewritten = append(rewritten, raw)
+			continue
+		}
+
+		cookie := parsed[0]
+		for _, host := range localHosts {
+			if host != "" && strings.EqualFold(strings.TrimPrefix(cookie.Domain, "."), host) {
+				cookie.Domain = publicHost
+				raw = cookie.String()
+				break
+			}
+		}
+
+		rewritten = append(rewritten, raw)
+	}
+
+	h["Set-Cookie"] = rewritten
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Brickchain/hass-proxy/pkg/config"
+	"github.com/spf13/viper"
+)
+
+// loadUpstream sets up the Home Assistant URL and Host that requests are passed on to
+func loadUpstream(t *testing.T, local, localHost string) {
+	viper.Set("local", local)
+	viper.Set("local_host", localHost)
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    http.Header
+	}{
+		{"hop headers", http.Header{"Keep-Alive": {"300"}, "Te": {"trailers"}, "Upgrade": {"h2c"}, "Accept": {"*/*"}}, http.Header{"Accept": {"*/*"}}},
+		{"listed in connection", http.Header{"Connection": {"close, X-Secret"}, "X-Secret": {"a"}, "X-Other": {"b"}}, http.Header{"X-Other": {"b"}}},
+		{"empty entries in connection", http.Header{"Connection": {" , ,"}, "Accept": {"*/*"}}, http.Header{"Accept": {"*/*"}}},
+	}
+
+	for _, test := range tests {
+		removeHopHeaders(test.headers)
+		if !reflect.DeepEqual(test.headers, test.want) {
+			t.Errorf("%s: headers %v, want %v", test.name, test.headers, test.want)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		host    string
+		want    http.Header
+	}{
+		{"no headers", http.Header{}, "tunnel.example", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"tunnel.example"}}},
+		{"spoofed host", http.Header{"X-Forwarded-Host": {"evil.example"}}, "tunnel.example", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"tunnel.example"}}},
+		{"spoofed address", http.Header{"X-Forwarded-For": {"127.0.0.1"}, "X-Real-Ip": {"127.0.0.1"}, "Forwarded": {"for=127.0.0.1"}}, "tunnel.example", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"tunnel.example"}}},
+		{"spoofed proto", http.Header{"X-Forwarded-Proto": {"http"}, "Accept": {"*/*"}}, "tunnel.example", http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"tunnel.example"}, "Accept": {"*/*"}}},
+		{"no hostname yet", http.Header{"X-Forwarded-Host": {"evil.example"}}, "", http.Header{"X-Forwarded-Proto": {"https"}}},
+	}
+
+	for _, test := range tests {
+		setForwardedHeaders(test.headers, test.host)
+		if !reflect.DeepEqual(test.headers, test.want) {
+			t.Errorf("%s: headers %v, want %v", test.name, test.headers, test.want)
+		}
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	loadUpstream(t, "http://hassio/homeassistant", "homeassistant.local")
+
+	tests := []struct {
+		name     string
+		location string
+		host     string
+		want     string
+	}{
+		{"local url", "http://hassio/homeassistant/lovelace?edit=1", "tunnel.example", "https://tunnel.example/lovelace?edit=1"},
+		{"local host", "http://homeassistant.local/auth/authorize", "tunnel.example", "https://tunnel.example/auth/authorize"},
+		{"other host", "https://accounts.example/login", "tunnel.example", "https://accounts.example/login"},
+		{"relative", "/lovelace", "tunnel.example", "/lovelace"},
+		{"no hostname yet", "http://hassio/homeassistant/lovelace", "", "http://hassio/homeassistant/lovelace"},
+	}
+
+	for _, test := range tests {
+		h := http.Header{"Location": {test.location}}
+		rewriteLocation(h, test.host)
+		if location := h.Get("Location"); location != test.want {
+			t.Errorf("%s: Location %s, want %s", test.name, location, test.want)
+		}
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	loadUpstream(t, "http://hassio/homeassistant", "homeassistant.local")
+
+	tests := []struct {
+		name   string
+		cookie string
+		host   string
+		want   string
+	}{
+		{"local url", "session=a; Domain=hassio; Path=/", "tunnel.example", "session=a; Path=/; Domain=tunnel.example"},
+		{"local host", "session=a; Domain=.homeassistant.local", "tunnel.example", "session=a; Domain=tunnel.example"},
+		{"host with port", "session=a; Domain=hassio", "tunnel.example:443", "session=a; Domain=tunnel.example"},
+		{"other domain", "session=a; Domain=accounts.example", "tunnel.example", "session=a; Domain=accounts.example"},
+		{"no domain", "session=a; Path=/", "tunnel.example", "session=a; Path=/"},
+		{"no hostname yet", "session=a; Domain=hassio", "", "session=a; Domain=hassio"},
+	}
+
+	for _, test := range tests {
+		h := http.Header{"Set-Cookie": {test.cookie}}
+		rewriteCookies(h, test.host)
+		if cookie := h.Get("Set-Cookie"); cookie != test.want {
+			t.Errorf("%s: Set-Cookie %s, want %s", test.name, cookie, test.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+	"github.com/Brickchain/hass-proxy/pkg/controller"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+)
+
+// when the proxy started, for the uptime in the health response
+var started = time.Now()
+
+// how long the health of Home Assistant is remembered, so that health checks can't be used to flood it
+const upstreamHealthTTL = time.Second * 5
+
+// healthStatus is all that is shown of the health without a mandate token
+type healthStatus struct {
+	// Status is ok when Home Assistant is reachable and we are registered to the controller, and degraded otherwise
+	Status string `json:"status"`
+}
+
+type healthResponse struct {
+	healthStatus
+	Upstream      upstreamHealth     `json:"upstream"`
+	Registration  registrationHealth `json:"registration"`
+	Hostname      string             `json:"hostname"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Version       string             `json:"version"`
+}
+
+type upstreamHealth struct {
+	Reachable bool   `json:"reachable"`
+	Version   string `json:"version,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type registrationHealth struct {
+	Registered bool   `json:"registered"`
+	Verified   bool   `json:"verified"`
+	AgeSeconds int64  `json:"age_seconds,omitempty"`
+	RealmKey   string `json:"realm_key,omitempty"`
+}
+
+// healthHandler serves /_health, which tells if Home Assistant can be reached and if we are registered to the
+// controller. The details are only shown to requests with a valid mandate token, which are verified, rate limited and
+// audited like any other tunneled request, or on the local listener.
+type healthHandler struct {
+	controller *controller.Controller
+	// local is set on the local listener, which shows the details without a mandate token
+	local bool
+	lock  *sync.Mutex
+	// upstream is the last health of Home Assistant, checked at checked
+	upstream upstreamHealth
+	checked  time.Time
+}
+
+func newHealthHandler(c *controller.Controller, local bool) *healthHandler {
+	return &healthHandler{
+		controller: c,
+		local:      local,
+		lock:       &sync.Mutex{},
+	}
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, h.local)
+}
+
+// serve writes the health, with the details if the request is allowed to see them
+func (h *healthHandler) serve(w http.ResponseWriter, r *http.Request, details bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := h.check()
+
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	if !details {
+		writeJSON(w, status, health.healthStatus)
+		return
+	}
+
+	writeJSON(w, status, health)
+}
+
+func (h *healthHandler) check() healthResponse {
+	health := healthResponse{
+		healthStatus:  healthStatus{Status: "ok"},
+		Upstream:      h.checkUpstream(),
+		Hostname:      h.controller.Audience(),
+		UptimeSeconds: int64(time.Since(started).Seconds()),
+		Version:       Version,
+	}
+
+	if !health.Upstream.Reachable {
+		health.Status = "degraded"
+	}
+
+	if realmKey := h.controller.RealmKey(); realmKey != nil {
+		health.Registration.Registered = true
+		health.Registration.Verified = h.controller.Verified()
+		health.Registration.AgeSeconds = int64(time.Since(h.controller.Registered()).Seconds())
+		health.Registration.RealmKey = crypto.Thumbprint(realmKey)
+	} else {
+		health.Status = "degraded"
+	}
+
+	return health
+}
+
+// checkUpstream returns the health of Home Assistant, which is only checked again once the last check is older than
+// upstreamHealthTTL. Health checks that come in while it is being checked wait for that check.
+func (h *healthHandler) checkUpstream() upstreamHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.checked.IsZero() && time.Since(h.checked) < upstreamHealthTTL {
+		return h.upstream
+	}
+
+	upstream := config.CurrentUpstream()
+	client := hass.NewClient(upstream.URL, upstream.Host, upstream.Token)
+
+	health := upstreamHealth{}
+	if err := client.Ping(); err != nil {
+		health.Error = err.Error()
+	} else {
+		health.Reachable = true
+		if version, err := client.Version(); err == nil {
+			health.Version = version
+		}
+	}
+
+	h.upstream, h.checked = health, time.Now()
+
+	return health
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+)
+
+// stripIdentityHeaders removes the identity headers that came with a request, so that remote users can't pose as
+// someone else
+func stripIdentityHeaders(h http.Header, upstream config.Upstream) {
+	if upstream.IdentityPrefix == "" {
+		return
+	}
+
+	for k := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), upstream.IdentityPrefix) {
+			h.Del(k)
+		}
+	}
+}
+
+// setIdentityHeaders tells Home Assistant who made a request, if identity_secret is set. The headers hold the
+// thumbprint of the key that signed the mandate token, the role names and senders of the mandates and the mandate
+// params from identity_params, with the values URL encoded. They are signed with an HMAC, see identitySignature.
+func setIdentityHeaders(h http.Header, r *http.Request, upstream config.Upstream, mandates []httphandler.AuthenticatedMandate) {
+	stripIdentityHeaders(h, upstream)
+
+	if upstream.IdentitySecret == "" || len(mandates) < 1 {
+		return
+	}
+
+	// keyed by lowercase header name, as they are signed
+	prefix := strings.ToLower(upstream.IdentityPrefix)
+	identity := make(map[string]string)
+
+	identity[prefix+"signer"] = signerOf(mandates)
+
+	roleNames := make([]string, 0, len(mandates))
+	senders := make([]string, 0, len(mandates))
+	for _, mandate := range mandates {
+		roleNames = append(roleNames, url.QueryEscape(mandate.Mandate.RoleName))
+		senders = append(senders, url.QueryEscape(mandate.Mandate.Sender))
+	}
+	identity[prefix+"role-name"] = strings.Join(roleNames, ",")
+	identity[prefix+"sender"] = strings.Join(senders, ",")
+
+	for _, param := range upstream.IdentityParams {
+		for _, mandate := range mandates {
+			if value, ok := mandate.Mandate.Params[param]; ok {
+				identity[prefix+"param-"+strings.ToLower(param)] = url.QueryEscape(value)
+				break
+			}
+		}
+	}
+
+	identity[prefix+"timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	for k, v := range identity {
+		h.Set(k, v)
+	}
+
+	h.Set(prefix+"signature", identitySignature(upstream.IdentitySecret, r.Method, r.URL.Path, r.URL.RawQuery, identity))
+}
+
+// identitySignature returns the hex encoded HMAC-SHA256 of the method, the path, the query and the identity headers,
+// written as lines of the method, the path, the raw query (empty if there is none) and then name:value for every
+// header, with lowercase names sorted by name
+func identitySignature(secret, method, path, query string, identity map[string]string) string {
+	names := make([]string, 0, len(identity))
+	for name := range identity {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{method, path, query}
+	for _, name := range names {
+		lines = append(lines, name+":"+identity[name])
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
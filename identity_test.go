@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	document "github.com/Brickchain/go-document.v2"
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+)
+
+// verifyIdentity checks the identity headers of a request the way an integration in Home Assistant would
+func verifyIdentity(r *http.Request, secret, prefix string) bool {
+	prefix = strings.ToLower(prefix)
+	identity := make(map[string]string)
+	for k := range r.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, prefix) && name != prefix+"signature" {
+			identity[name] = r.Header.Get(k)
+		}
+	}
+
+	want := identitySignature(secret, r.Method, r.URL.Path, r.URL.RawQuery, identity)
+
+	return hmac.Equal([]byte(r.Header.Get(prefix+"signature")), []byte(want))
+}
+
+func TestIdentitySignature(t *testing.T) {
+	identity := map[string]string{
+		"x-hass-proxy-signer":    "thumbprint",
+		"x-hass-proxy-timestamp": "1500000000",
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("GET\n/api/history/period\nfilter_entity_id=light.hall\nx-hass-proxy-signer:thumbprint\nx-hass-proxy-timestamp:1500000000"))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if signature := identitySignature("secret", "GET", "/api/history/period", "filter_entity_id=light.hall", identity); signature != want {
+		t.Errorf("signature %s, want %s", signature, want)
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	upstream := config.Upstream{
+		IdentitySecret: "secret",
+		IdentityPrefix: "X-Hass-Proxy-",
+		IdentityParams: []string{"room"},
+	}
+	mandates := []httphandler.AuthenticatedMandate{{Mandate: &document.Mandate{
+		RoleName: "Guest",
+		Sender:   "admin@realm.example",
+		Params:   map[string]string{"room": "kitchen"},
+	}}}
+
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request)
+		valid  bool
+	}{
+		{"untouched", func(r *http.Request) {}, true},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "filter_entity_id=lock.front_door" }, false},
+		{"query removed", func(r *http.Request) { r.URL.RawQuery = "" }, false},
+		{"path", func(r *http.Request) { r.URL.Path = "/api/history/period/2017-07-14" }, false},
+		{"method", func(r *http.Request) { r.Method = "POST" }, false},
+		{"header", func(r *http.Request) { r.Header.Set("X-Hass-Proxy-Role-Name", "Admin") }, false},
+		{"header added", func(r *http.Request) { r.Header.Set("X-Hass-Proxy-Param-Door", "front") }, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/history/period?filter_entity_id=light.hall", nil)
+		r.Header.Set("X-Hass-Proxy-Role-Name", "Spoofed")
+		setIdentityHeaders(r.Header, r, upstream, mandates)
+
+		if role := r.Header.Get("X-Hass-Proxy-Role-Name"); role != "Guest" {
+			t.Fatalf("role name header %s, want the one from the mandate", role)
+		}
+
+		test.tamper(r)
+		if valid := verifyIdentity(r, upstream.IdentitySecret, upstream.IdentityPrefix); valid != test.valid {
+			t.Errorf("%s: valid = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/states", nil)
+	setIdentityHeaders(r.Header, r, upstream, mandates)
+	if verifyIdentity(r, "other secret", upstream.IdentityPrefix) {
+		t.Error("signature is valid with another secret")
+	}
+}
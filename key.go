@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// PEM block type of key files that are encrypted with a passphrase. The block holds the PEM encoded key as a JWE,
+// encrypted with a key that is derived from the passphrase with PBKDF2.
+const encryptedKeyType = "HASS PROXY ENCRYPTED KEY"
+
+// PBKDF2 iterations for new encrypted key files
+const keyIterations = 100000
+
+// loadOrCreateKey loads the key of the tunnel, and creates it if there isn't one yet
+func loadOrCreateKey(file string) (*jose.JsonWebKey, error) {
+	if _, err := os.Stat(file); err != nil {
+		return createKey(file)
+	}
+
+	return readKey(file)
+}
+
+// readKey reads a key from a PEM file, decrypting it with the key_passphrase setting if it is encrypted
+func readKey(file string) (*jose.JsonWebKey, error) {
+	kb, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key file")
+	}
+
+	passphrase := viper.GetString("key_passphrase")
+
+	block, _ := pem.Decode(kb)
+	if block != nil && block.Type == encryptedKeyType {
+		if passphrase == "" {
+			return nil, errors.New("key file is encrypted, but key_passphrase is not set")
+		}
+
+		if kb, err = decryptKey(block, passphrase); err != nil {
+			return nil, err
+		}
+	} else if passphrase != "" {
+		logger.Warningf("Key file %s is not encrypted, run rotate-key to replace it with an encrypted key", file)
+	}
+
+	key, err := crypto.UnmarshalPEM(kb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse key file")
+	}
+
+	return key, nil
+}
+
+// createKey creates a new key and writes it to a PEM file
+func createKey(file string) (*jose.JsonWebKey, error) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create key")
+	}
+
+	if err := writeKey(file, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// writeKey writes a key to a PEM file that only we can read, encrypted if the key_passphrase setting is set. The file
+// is replaced in one go, so that a running proxy never sees a half written key.
+func writeKey(file string, key *jose.JsonWebKey) error {
+	kb, err := crypto.MarshalToPEM(key)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal key")
+	}
+
+	if passphrase := viper.GetString("key_passphrase"); passphrase != "" {
+		if kb, err = encryptKey(kb, passphrase); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return errors.Wrap(err, "failed to create key file")
+	}
+
+	if _, err := tmp.Write(kb); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write key file")
+	}
+	tmp.Close()
+
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to set key file permissions")
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to move key file into place")
+	}
+
+	return nil
+}
+
+func encryptKey(kb []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "failed to create salt")
+	}
+
+	enc, err := crypto.NewSymmetricEncrypter(pbkdf2([]byte(passphrase), salt, keyIterations, 32))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create encrypter")
+	}
+
+	jwe, err := enc.Encrypt(kb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt key")
+	}
+
+	compact, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize encrypted key")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"Salt":       base64.StdEncoding.EncodeToString(salt),
+			"Iterations": strconv.Itoa(keyIterations),
+		},
+		Bytes: []byte(compact),
+	}), nil
+}
+
+func decryptKey(block *pem.Block, passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil || len(salt) < 1 {
+		return nil, errors.New("encrypted key file has no salt")
+	}
+
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("encrypted key file has no iteration count")
+	}
+
+	jwe, err := crypto.UnmarshalJWE(string(block.Bytes))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse encrypted key")
+	}
+
+	kb, err := jwe.Decrypt(pbkdf2([]byte(passphrase), salt, iterations, 32))
+	if err != nil {
+		return nil, errors.New("failed to decrypt key file, is key_passphrase correct?")
+	}
+
+	return kb, nil
+}
+
+// pbkdf2 derives a key from a passphrase as described in RFC 8018, using HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen)
+
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/limit"
+	"github.com/spf13/viper"
+)
+
+// limits are the rate limits and concurrency caps for requests through the tunnel
+type limits struct {
+	global     *limit.Limiter
+	user       *limit.Limiter
+	role       *limit.Limiter
+	failed     *limit.Limiter
+	requests   *limit.Concurrency
+	websockets *limit.Concurrency
+}
+
+// newLimits returns the limits from the rate limit settings
+func newLimits() *limits {
+	l := &limits{
+		global:     limit.NewLimiter(limit.Rate{}),
+		user:       limit.NewLimiter(limit.Rate{}),
+		role:       limit.NewLimiter(limit.Rate{}),
+		failed:     limit.NewLimiter(limit.Rate{}),
+		requests:   limit.NewConcurrency(0),
+		websockets: limit.NewConcurrency(0),
+	}
+	l.configure()
+
+	return l
+}
+
+// configure applies the rate limit settings, keeping the state of the limits
+func (l *limits) configure() {
+	for setting, limiter := range map[string]*limit.Limiter{
+		"rate_limit":        l.global,
+		"rate_limit_user":   l.user,
+		"rate_limit_role":   l.role,
+		"rate_limit_failed": l.failed,
+	} {
+		// the settings are validated before they are applied
+		rate, err := limit.ParseRate(viper.GetString(setting))
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		limiter.SetRate(rate)
+	}
+
+	l.requests.SetMax(viper.GetInt("max_requests_per_user"))
+	l.websockets.SetMax(viper.GetInt("max_websockets_per_user"))
+}
+
+// rateCheck is one of the rate limits a request has to pass, with the bucket it is counted in
+type rateCheck struct {
+	limiter *limit.Limiter
+	key     string
+}
+
+// allow checks the global, per user and per role rate limits for an authorized request. Tokens are only taken once
+// all of them allow the request, so that a request turned away by one limit doesn't count against the others.
+func (l *limits) allow(signer string, mandates []httphandler.AuthenticatedMandate) (failure, bool) {
+	checks := []rateCheck{{l.global, ""}, {l.user, signer}}
+
+	roles := make(map[string]bool)
+	for _, mandate := range mandates {
+		if !roles[mandate.Mandate.Role] {
+			roles[mandate.Mandate.Role] = true
+			checks = append(checks, rateCheck{l.role, mandate.Mandate.Role})
+		}
+	}
+
+	for _, check := range checks {
+		if ok, wait := check.limiter.Check(check.key); !ok {
+			return rateLimited(failureRateLimited, wait), false
+		}
+	}
+
+	for _, check := range checks {
+		check.limiter.Take(check.key)
+	}
+
+	return failure{}, true
+}
+
+// failedAttempt counts a request that failed verification. All failed attempts share one limit, since the tunnel
+// doesn't tell us who is making them.
+func (l *limits) failedAttempt() (failure, bool) {
+	if ok, wait := l.failed.Allow(""); !ok {
+		return rateLimited(failureTooManyFailures, wait), false
+	}
+
+	return failure{}, true
+}
+
+// rateLimited returns the failure with the time until the request can be retried
+func rateLimited(f failure, wait time.Duration) failure {
+	f.retryAfter = int(math.Ceil(wait.Seconds()))
+	if f.retryAfter < 1 {
+		f.retryAfter = 1
+	}
+
+	return f
+}
+
+// signerOf returns the thumbprint of the key that signed the mandate token, which is who the mandates are issued to
+func signerOf(mandates []httphandler.AuthenticatedMandate) string {
+	for _, mandate := range mandates {
+		if mandate.Mandate.Recipient != nil {
+			return crypto.Thumbprint(mandate.Mandate.Recipient)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	document "github.com/Brickchain/go-document.v2"
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	"github.com/Brickchain/hass-proxy/pkg/limit"
+)
+
+func roleMandates(roles ...string) []httphandler.AuthenticatedMandate {
+	mandates := make([]httphandler.AuthenticatedMandate, 0, len(roles))
+	for _, role := range roles {
+		mandates = append(mandates, httphandler.AuthenticatedMandate{Mandate: &document.Mandate{Role: role}})
+	}
+
+	return mandates
+}
+
+// limitStep is a request from signer with mandates for roles, and whether the limits should allow it
+type limitStep struct {
+	signer  string
+	roles   []string
+	allowed bool
+}
+
+func TestLimitsAllow(t *testing.T) {
+	tests := []struct {
+		name               string
+		global, user, role string
+		steps              []limitStep
+	}{
+		{"user limit doesn't use up the global one", "2/1h", "1/1h", "", []limitStep{
+			{"alice", nil, true},
+			{"alice", nil, false},
+			{"bob", nil, true},
+			{"carol", nil, false},
+		}},
+		{"role limit doesn't use up the user one", "", "2/1h", "1/1h", []limitStep{
+			{"alice", []string{"guest@realm"}, true},
+			{"alice", []string{"guest@realm"}, false},
+			{"alice", []string{"admin@realm"}, true},
+			{"alice", []string{"admin@realm"}, false},
+		}},
+		{"every role has to allow", "", "", "1/1h", []limitStep{
+			{"alice", []string{"guest@realm"}, true},
+			{"bob", []string{"admin@realm", "guest@realm"}, false},
+			{"bob", []string{"admin@realm"}, true},
+		}},
+		{"a role is counted once per request", "", "", "1/1h", []limitStep{
+			{"alice", []string{"guest@realm", "guest@realm"}, true},
+			{"alice", []string{"guest@realm"}, false},
+		}},
+		{"unlimited", "", "", "", []limitStep{
+			{"alice", []string{"guest@realm"}, true},
+			{"alice", []string{"guest@realm"}, true},
+		}},
+	}
+
+	for _, test := range tests {
+		l := newLimits()
+		for limiter, s := range map[*limit.Limiter]string{l.global: test.global, l.user: test.user, l.role: test.role} {
+			rate, err := limit.ParseRate(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limiter.SetRate(rate)
+		}
+
+		for i, step := range test.steps {
+			f, allowed := l.allow(step.signer, roleMandates(step.roles...))
+			if allowed != step.allowed {
+				t.Errorf("%s: step %d: allowed = %v, want %v", test.name, i+1, allowed, step.allowed)
+			}
+
+			if !allowed && (f.reason != failureRateLimited.reason || f.retryAfter < 1) {
+				t.Errorf("%s: step %d: failure %+v", test.name, i+1, f)
+			}
+		}
+	}
+}
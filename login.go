@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/pkg/errors"
+)
+
+// savedLogin is the refresh token we got by logging in to Home Assistant with the password, as it is kept in the login
+// file
+type savedLogin struct {
+	Username     string `json:"username"`
+	ClientID     string `json:"client_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// storedLogin gets access tokens for the controller from Home Assistant with the password, and keeps the refresh
+// token in a file. Every login leaves a refresh token behind in Home Assistant, so the one in the file is used for as
+// long as it is valid, after a restart and after the hostname changes, instead of logging in again.
+type storedLogin struct {
+	auth     *hass.Auth
+	username string
+	file     string
+	lock     *sync.Mutex
+	saved    string
+}
+
+// newStoredLogin returns a new instance of storedLogin, with the refresh token from the file if it was handed out to
+// the same user
+func newStoredLogin(client *hass.Client, username, password, file string) *storedLogin {
+	l := &storedLogin{
+		auth:     hass.NewAuth(client, username, password),
+		username: username,
+		file:     file,
+		lock:     &sync.Mutex{},
+	}
+
+	saved, err := readLogin(file)
+	if err != nil {
+		logger.Warn(errors.Wrap(err, "failed to read login file, logging in again"))
+		return l
+	}
+
+	if saved.Username == username && saved.ClientID != "" && saved.RefreshToken != "" {
+		l.auth.SetRefreshToken(saved.ClientID, saved.RefreshToken)
+		l.saved = saved.RefreshToken
+	}
+
+	return l
+}
+
+// Token returns a valid access token, and saves the refresh token if we had to log in to get it
+func (l *storedLogin) Token(clientID string) (string, error) {
+	token, err := l.auth.Token(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if refreshToken := l.auth.RefreshToken(); refreshToken != l.saved {
+		if err := writeLogin(l.file, savedLogin{
+			Username:     l.username,
+			ClientID:     l.auth.ClientID(),
+			RefreshToken: refreshToken,
+		}); err != nil {
+			logger.Warn(errors.Wrap(err, "failed to save login, we will log in again after a restart"))
+		} else {
+			l.saved = refreshToken
+		}
+	}
+
+	return token, nil
+}
+
+// readLogin reads the login file, a file that doesn't exist has no login
+func readLogin(file string) (savedLogin, error) {
+	saved := savedLogin{}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return saved, err
+	}
+
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return saved, errors.Wrap(err, "failed to parse login file")
+	}
+
+	return saved, nil
+}
+
+// writeLogin writes the login file so that only we can read it, since it holds the refresh token
+func writeLogin(file string, saved savedLogin) error {
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal login")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return errors.Wrap(err, "failed to create login file")
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write login file")
+	}
+	tmp.Close()
+
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to set login file permissions")
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to move login file into place")
+	}
+
+	return nil
+}
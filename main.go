@@ -1,113 +1,240 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	crypto "github.com/Brickchain/go-crypto.v2"
 	logger "github.com/Brickchain/go-logger.v1"
-	"github.com/Brickchain/go-proxy.v1/pkg/client"
+	"github.com/Brickchain/hass-proxy/pkg/audit"
+	"github.com/Brickchain/hass-proxy/pkg/config"
 	"github.com/Brickchain/hass-proxy/pkg/controller"
-	"github.com/joho/godotenv"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/Brickchain/hass-proxy/pkg/policy"
+	"github.com/Brickchain/hass-proxy/pkg/users"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
-	jose "gopkg.in/square/go-jose.v1"
 )
 
 // Version holds the version we're currently running
 var Version = "dev"
 
 func main() {
-	_ = godotenv.Load(".env")
-	viper.AutomaticEnv()
-	viper.SetDefault("log_formatter", "text")
-	viper.SetDefault("log_level", "info")
-	viper.SetDefault("secret", "")
-	viper.SetDefault("remote", "https://hass.svc.integrity.app/service/hass/tunnel")
-	viper.SetDefault("proxy_endpoint", "https://proxy.svc.integrity.app")
-	viper.SetDefault("local", "http://hassio/homeassistant")
-	viper.SetDefault("local_host", "hassio")
-	viper.SetDefault("password", "")
-	viper.SetDefault("key", "hass-proxy.pem")
-	viper.SetDefault("hassio_token", "")
-
-	logger.SetLevel(viper.GetString("log_level"))
-	logger.SetFormatter(viper.GetString("log_formatter"))
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runProxy connects the tunnel and serves requests until the connection to the proxy ends
+func runProxy(args []string) int {
+	if status, ok := parseFlags(newFlagSet("run"), args); !ok {
+		return status
+	}
+
+	if err := config.Load(); err != nil {
+		logger.Fatal(err)
+	}
+
+	setLogging()
 
 	logger.Infof("Starting Brickchain HASS Proxy version %s", Version)
 
-	if viper.GetString("secret") == "" {
-		logger.Fatalf("You need to set a secret!")
+	problems := config.Validate()
+	for _, problem := range problems.Warnings() {
+		logger.Warn(problem)
+	}
+	if errs := problems.Errors(); len(errs) > 0 {
+		for _, problem := range errs {
+			logger.Error(problem)
+		}
+		logger.Fatalf("Invalid configuration, run check-config for details")
+	}
+
+	// authenticate to the controller either with a secret, or by logging in to Home Assistant with a password
+	credentials, err := newCredentials()
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	// split out the binding and secret parts of the secret environment variable
-	parts := strings.Split(viper.GetString("secret"), ".")
-	binding := parts[0]
-	secret := parts[1]
+	// keep the revocation list from the controller, with a copy on disk next to the key file
+	revocations := controller.NewRevocations(config.RevocationURL(), config.RevocationFile())
+	if err := revocations.Load(); err != nil {
+		logger.Warn(err)
+	}
 
 	controller := controller.NewController(viper.GetString("remote"), Version)
+	controller.SetClockSkew(viper.GetDuration("token_clock_skew"))
+	if viper.GetBool("token_single_use") {
+		controller.SetSingleUse(viper.GetInt("token_cache_size"))
+	}
+	controller.SetRevocations(revocations)
+	controller.SetCredentials(credentials)
+	controller.SetPinnedKeys(viper.GetString("controller_key"), viper.GetString("realm_key"))
+
+	// use the registration from the last run until we have been able to register again
+	controller.SetCacheFile(config.RegistrationFile())
+	if err := controller.LoadCache(); err != nil {
+		logger.Warn(err)
+	}
+
+	// the revocation list is verified with the registration, so it is only refreshed once that is loaded
+	go revocations.Run(viper.GetDuration("revocation_refresh"))
+
+	// load the access policy for the mandate roles
+	policies := policy.NewEngine()
+	if err := loadPolicy(policies); err != nil {
+		logger.Fatal(err)
+	}
 
-	var key *jose.JsonWebKey
+	// load the Home Assistant users that realm users act as
+	userMap := users.NewMap()
+	if err := loadUsers(userMap); err != nil {
+		logger.Fatal(err)
+	}
 
-	// check if there is already a key file present on the filesystem and load it, otherwise create one
-	_, err := os.Stat(viper.GetString("key"))
+	// load the key of the tunnel, or create one the first time we start
+	key, err := loadOrCreateKey(viper.GetString("key"))
 	if err != nil {
-		key, err = crypto.NewKey()
-		if err != nil {
-			logger.Fatal(err)
-		}
+		logger.Fatal(err)
+	}
 
-		kb, err := crypto.MarshalToPEM(key)
-		if err != nil {
-			logger.Fatal(err)
-		}
+	// write who did what to the audit log, if there is one
+	auditLog := newAuditLog()
+	limits := newLimits()
 
-		if err := ioutil.WriteFile(viper.GetString("key"), kb, 0600); err != nil {
-			logger.Fatal(err)
-		}
+	// connect to the proxy
+	drain := newDrainer()
+	t := newTunnel(key, &httpClient{
+		controller: controller,
+		policy:     policies,
+		drain:      drain,
+		health:     newHealthHandler(controller, false),
+		audit:      auditLog,
+		limits:     limits,
+		users:      userMap,
+	}, controller)
+	if err := t.Connect(viper.GetString("proxy_endpoint"), 0); err != nil {
+		logger.Fatal(err)
+	}
+
+	// register to the Brickchain HASS Controller in the background, so that we keep serving with the saved
+	// registration while the controller is unreachable, and keep the registration up to date
+	go controller.Run(viper.GetDuration("registration_refresh"))
+
+	// apply changes to the config and policy files without restarting
+	watcher, err := config.NewWatcher()
+	if err != nil {
+		logger.Warn(err)
 	} else {
-		kb, err := ioutil.ReadFile(viper.GetString("key"))
-		if err != nil {
-			logger.Fatal(err)
+		if err := watcher.SetFiles(watchedFiles()); err != nil {
+			logger.Warn(err)
 		}
 
-		key, err = crypto.UnmarshalPEM(kb)
-		if err != nil {
-			logger.Fatal(err)
+		r := &reloader{
+			controller: controller,
+			policies:   policies,
+			tunnel:     t,
+			limits:     limits,
+			users:      userMap,
+			watcher:    watcher,
+			lock:       &sync.Mutex{},
 		}
+		go watcher.Run(r.reload)
 	}
 
-	// connect to the proxy
-	p, err := client.NewProxyClient(viper.GetString("proxy_endpoint"))
-	if err != nil {
-		logger.Fatal(err)
-	} else {
-		hostname, err := p.Register(key)
-		if err != nil {
-			logger.Fatal(err)
-		}
+	// serve metrics and health details locally if asked to
+	if address := viper.GetString("metrics_listen"); address != "" {
+		go serveLocal(address, controller)
+	}
+
+	// shut down gracefully when we are asked to stop
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	ended := make(chan struct{})
+	go func() {
+		t.Wait()
+		close(ended)
+	}()
+
+	select {
+	case <-ended:
+		logger.Error("Connection to the proxy ended")
+		return 1
+	case sig := <-signals:
+		logger.Infof("Received %s, shutting down", sig)
+	}
+
+	// a second signal skips the draining
+	go func() {
+		<-signals
+		logger.Warn("Received another signal, exiting right away")
+		os.Exit(1)
+	}()
+
+	if watcher != nil {
+		watcher.Close()
+	}
+	revocations.Stop()
+
+	status := shutdown(t, drain, controller)
 
-		logger.Infof("Got hostname: %s", hostname)
+	if auditLog != nil {
+		auditLog.Close()
+	}
 
-		p.SetHandler(&httpClient{controller})
+	return status
+}
 
-		// register to the Brickchain HASS Controller
-		if err := controller.Register(fmt.Sprintf("https://%s", hostname), binding, secret); err != nil {
-			logger.Fatal(err)
+// shutdown lets the requests and websocket sessions that are being served finish, tells the controller that we are
+// going offline if notify_offline is set, and then disconnects from the proxy. It returns the exit status, which is
+// 1 if anything had to be aborted.
+func shutdown(t *tunnel, drain *drainer, c *controller.Controller) int {
+	status := 0
+
+	timeout := viper.GetDuration("shutdown_timeout")
+	logger.Infof("Waiting up to %s for requests to finish", timeout)
+	if !drain.Drain(timeout) {
+		logger.Warn("Aborted requests that were still running after the shutdown timeout")
+		status = 1
+	}
+
+	if viper.GetBool("notify_offline") {
+		if err := c.Unregister(fmt.Sprintf("https://%s", c.Audience())); err != nil {
+			logger.Warn(errors.Wrap(err, "failed to tell the controller that we are going offline"))
 		}
 	}
 
-	p.Wait()
+	if err := t.Disconnect(); err != nil {
+		logger.Warn(errors.Wrap(err, "failed to disconnect from the proxy"))
+		status = 1
+	}
+
+	logger.Info("Shut down")
+
+	return status
 }
 
 type httpClient struct {
 	controller *controller.Controller
+	policy     *policy.Engine
+	drain      *drainer
+	health     *healthHandler
+	audit      *audit.Log
+	limits     *limits
+	users      *users.Map
 }
 
 func (h *httpClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tunnelActivity()
 
 	// just return an OK on the /_ping endpoint
 	if r.URL.Path == "/_ping" {
@@ -115,62 +242,328 @@ func (h *httpClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// and tell how we are doing on the /_health endpoint. Health checks with a mandate token are served like any
+	// other request below, so that they are verified, rate limited and audited before they get the details.
+	if r.URL.Path == "/_health" && r.Header.Get("Authorization") == "" {
+		h.health.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	record := &audit.Record{
+		Time:   start.UTC(),
+		Method: r.Method,
+		Path:   r.URL.Path,
+	}
+	auditPath(record, r)
+
+	h.serve(sw, r, record)
+
+	observeRequest(r, sw.status, time.Since(start))
+	if h.audit != nil {
+		h.writeAudit(record, sw, time.Since(start))
+	}
+}
+
+func (h *httpClient) serve(w http.ResponseWriter, r *http.Request, record *audit.Record) {
+	// turn away new requests once we are shutting down
+	if !h.drain.begin() {
+		writeFailure(w, r, failureShutdown)
+		return
+	}
+	defer h.drain.end()
+
 	logger.Debugf("Request for %s%s", r.Host, r.URL.Path)
 
-	// check that the request is authorized to talk to us
-	if !h.controller.Verify(r) {
-		w.WriteHeader(http.StatusUnauthorized)
+	// check that the request is authorized to talk to us. Health checks don't use up single-use tokens.
+	verify := h.controller.Verify
+	if r.URL.Path == "/_health" {
+		verify = h.controller.VerifyWithoutRecording
+	}
+	result := verify(r)
+	if !result.OK() {
+		// slow down anyone probing with tokens that aren't valid
+		if f, ok := h.limits.failedAttempt(); !ok {
+			writeFailure(w, r, f)
+			return
+		}
+
+		writeUnauthorized(w, result)
 		return
 	}
+	mandates := result.Mandates
+	auditMandates(record, mandates)
 
-	// create the http request that we should send to the HomeAssistant api
-	req, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", viper.GetString("local"), r.URL.Path), r.Body)
+	// keep a single user or role from flooding Home Assistant
+	signer := signerOf(mandates)
+	if f, ok := h.limits.allow(signer, mandates); !ok {
+		writeFailure(w, r, f)
+		return
+	}
+
+	// authorized health checks get the details, without going on to Home Assistant
+	if r.URL.Path == "/_health" {
+		h.health.serve(w, r, true)
+		return
+	}
+
+	// find the Home Assistant user the caller is mapped to
+	userToken, ok := h.userToken(w, r, signer, mandates)
+	if !ok {
+		return
+	}
+
+	// check that the mandates allows this method and path
+	decision := h.policy.Check(r.Method, r.URL.Path, mandates)
+	if !decision.Allowed {
+		logger.Debugf("Request for %s %s denied: %s", r.Method, r.URL.Path, decision.Reason)
+		writeJSON(w, http.StatusForbidden, errorResponse{
+			Error:  "forbidden",
+			Reason: decision.Reason,
+			Rule:   decision.Rule,
+			Role:   decision.Role,
+		})
+		return
+	}
+
+	// limit the request to the entities that the mandates which allow this method and path give access to
+	permitting := h.policy.Permitting(r.Method, r.URL.Path, mandates)
+	scope := h.policy.Scope(permitting)
+	if scope != nil && !checkEntityScope(w, r, scope) {
+		return
+	}
+
+	if h.audit != nil && !auditServiceCall(w, r, record) {
+		return
+	}
+
+	// websocket connections, such as the Home Assistant /api/websocket endpoint, are relayed frame by frame
+	if websocket.IsWebSocketUpgrade(r) {
+		if !h.limits.websockets.Acquire(signer) {
+			writeFailure(w, r, failureConcurrency)
+			return
+		}
+		defer h.limits.websockets.Release(signer)
+
+		h.serveWebSocket(w, r, permitting, mandates, userToken, record)
+		return
+	}
+
+	if !h.limits.requests.Acquire(signer) {
+		writeFailure(w, r, failureConcurrency)
+		return
+	}
+	defer h.limits.requests.Release(signer)
+
+	// cancel the upstream request if it stays idle for too long, or takes longer than the request timeout
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// and abort it if it is still running when the shutdown deadline passes
+	go func() {
+		select {
+		case <-h.drain.aborted():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	upstream := config.CurrentUpstream()
+	idle := newIdleTimer(upstream.IdleTimeout, upstream.RequestTimeout, cancel)
+	defer idle.stop()
+
+	// stream the request body to Home Assistant instead of buffering it
+	var body io.ReadCloser
+	if r.Body != nil {
+		body = &idleReader{ReadCloser: r.Body, timer: idle}
+	}
+
+	local, err := localURL(r)
 	if err != nil {
-		logger.Error(err)
+		logger.Error(errors.Wrap(err, "failed to parse local url"))
+		writeFailure(w, r, failureInternal)
 		return
 	}
 
-	// copy headers
-	for k, v := range r.Header {
-		req.Header.Set(k, v[0])
+	// create the http request that we should send to the HomeAssistant api
+	req, err := http.NewRequest(r.Method, local.String(), body)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "failed to create request"))
+		writeFailure(w, r, failureInternal)
+		return
 	}
+	req = req.WithContext(ctx)
+	req.ContentLength = contentLength(r)
+
+	// copy headers, leaving out the ones that only apply to the tunneled connection
+	copyHeader(req.Header, r.Header)
+	removeHopHeaders(req.Header)
 	req.Header.Del("Authorization")
+	setForwardedHeaders(req.Header, h.controller.Audience())
+	setIdentityHeaders(req.Header, r, upstream, mandates)
 
 	// set the local hostname
-	req.Header.Set("Host", viper.GetString("local_host"))
+	req.Host = localHost(local)
 
-	// set the X-HASSIO-KEY header based on the HASSIO_TOKEN environment variable
-	if viper.GetString("hassio_token") != "" {
-		req.Header.Set("X-HA-ACCESS", viper.GetString("hassio_token"))
+	// state lists are filtered by entity scope, so we need them uncompressed
+	filterStates := scope != nil && hass.IsStateList(r.Method, policy.CleanPath(r.URL.Path))
+	if filterStates {
+		req.Header.Del("Accept-Encoding")
 	}
 
-	client := &http.Client{
-		Timeout: time.Second * 15,
+	// act as the Home Assistant user the caller is mapped to, or else set the X-HASSIO-KEY header based on the
+	// HASSIO_TOKEN environment variable
+	if userToken != "" {
+		req.Header.Set("Authorization", "Bearer "+userToken)
+	} else if upstream.Token != "" {
+		req.Header.Set("X-HA-ACCESS", upstream.Token)
 	}
 
 	// execute the request
-	res, err := client.Do(req)
+	res, err := upstreamClient.Do(req)
 	if err != nil {
-		logger.Error(err)
+		select {
+		case <-r.Context().Done():
+			// the remote user went away, so there is no one to tell
+			logger.Debug(errors.Wrap(err, "request canceled"))
+		case <-h.drain.aborted():
+			writeFailure(w, r, failureShutdown)
+		default:
+			logger.Error(err)
+			f := upstreamFailure(err, idle)
+			upstreamErrors.Inc(f.reason)
+			writeFailure(w, r, f)
+		}
 		return
 	}
+	defer res.Body.Close()
+	res.Body = &idleReader{ReadCloser: res.Body, timer: idle}
 
-	// write response code to the proxy response
-	w.WriteHeader(res.StatusCode)
-
-	// copy response headers to the proxy response
-	for k, v := range res.Header {
-		w.Header().Set(k, v[0])
+	if upstreamStarting(res) {
+		upstreamErrors.Inc(failureStarting.reason)
+		writeFailure(w, r, failureStarting)
+		return
 	}
 
-	// read the response body
-	body, err := ioutil.ReadAll(res.Body)
+	// copy response headers to the proxy response, pointing redirects and cookies at the tunnel
+	removeHopHeaders(res.Header)
+	rewriteLocation(res.Header, h.controller.Audience())
+	rewriteCookies(res.Header, h.controller.Audience())
+	copyHeader(w.Header(), res.Header)
+
+	// go-proxy sends the response through the tunnel in a single message once we return, so the body is held in
+	// memory either way. Reading it here bounds how large that gets, and lets us answer with an error instead.
+	resBody, err := readResponse(res.Body, upstream.MaxResponseSize)
 	if err != nil {
-		logger.Error(err)
+		f := failureTooLarge
+		if err != errResponseTooLarge {
+			logger.Error(errors.Wrap(err, "failed to read response body"))
+			f = upstreamFailure(err, idle)
+		}
+		upstreamErrors.Inc(f.reason)
+		writeFailure(w, r, f)
 		return
 	}
 
-	// write body to the proxy response
-	w.Write(body)
+	if filterStates && res.StatusCode == http.StatusOK {
+		writeFilteredStates(w, res, resBody, scope)
+		return
+	}
+
+	// write response code and body to the proxy response
+	w.WriteHeader(res.StatusCode)
+	w.Write(resBody)
+}
+
+// upstreamClient is used for all requests towards Home Assistant. It has no overall timeout since WebSocket
+// connections are long lived, instead every request is bounded by the idle and request timeouts.
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+	// redirects are passed on to the remote user instead of being followed
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// errResponseTooLarge is returned by readResponse when the body is larger than the limit
+var errResponseTooLarge = errors.New("response body is too large")
+
+// readResponse reads a response body of at most limit bytes
+func readResponse(body io.Reader, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) > limit {
+		return nil, errResponseTooLarge
+	}
+
+	return b, nil
+}
+
+// idleTimer cancels a request when no data has been read from either the request or the response body for the
+// duration of the idle timeout, or when it is still running after the request timeout, if there is one
+type idleTimer struct {
+	timer    *time.Timer
+	deadline *time.Timer
+	timeout  time.Duration
+	fired    int32
+}
+
+func newIdleTimer(timeout, requestTimeout time.Duration, cancel context.CancelFunc) *idleTimer {
+	t := &idleTimer{
+		timeout: timeout,
+	}
+	expire := func() {
+		atomic.StoreInt32(&t.fired, 1)
+		cancel()
+	}
+	t.timer = time.AfterFunc(timeout, expire)
+	if requestTimeout > 0 {
+		t.deadline = time.AfterFunc(requestTimeout, expire)
+	}
+
+	return t
+}
+
+// expired returns true if the idle or request timeout has passed and the request was canceled
+func (t *idleTimer) expired() bool {
+	return atomic.LoadInt32(&t.fired) == 1
+}
+
+func (t *idleTimer) touch() {
+	t.timer.Reset(t.timeout)
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+	if t.deadline != nil {
+		t.deadline.Stop()
+	}
+}
+
+// idleReader resets the idle timer every time data is read
+type idleReader struct {
+	io.ReadCloser
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.touch()
+	}
 
+	return n, err
 }
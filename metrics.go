@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/controller"
+	"github.com/Brickchain/hass-proxy/pkg/metrics"
+	"github.com/Brickchain/hass-proxy/pkg/policy"
+	"github.com/pkg/errors"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	requestsTotal = metricsRegistry.NewCounterVec("hass_proxy_requests_total",
+		"Requests served through the tunnel.", "method", "status", "path")
+	requestDuration = metricsRegistry.NewHistogramVec("hass_proxy_request_duration_seconds",
+		"Time taken to serve requests through the tunnel.", metrics.DefaultBuckets, "method", "status", "path")
+	authorizations = metricsRegistry.NewCounterVec("hass_proxy_authorizations_total",
+		"Mandate token verifications, by outcome.", "reason")
+	upstreamErrors = metricsRegistry.NewCounterVec("hass_proxy_upstream_errors_total",
+		"Requests that Home Assistant could not serve, by reason.", "reason")
+	websocketSessions = metricsRegistry.NewGaugeVec("hass_proxy_websocket_sessions",
+		"WebSocket sessions that are open.")
+	tunnelConnected = metricsRegistry.NewGaugeVec("hass_proxy_tunnel_connected",
+		"Whether the tunnel is registered to the proxy.")
+	tunnelReconnects = metricsRegistry.NewCounterVec("hass_proxy_tunnel_reconnects_total",
+		"Times the tunnel has connected to the proxy again, by reason.", "reason")
+	registrations = metricsRegistry.NewCounterVec("hass_proxy_registrations_total",
+		"Attempts to register to the controller, by result.", "result")
+
+	// unix time in nanoseconds of the last request or ping from the proxy
+	lastTunnelActivity int64
+)
+
+// path groups that requests are counted by, anything else is counted as other so that the number of series stays small
+var metricsPathGroups = []string{
+	"/api/websocket",
+	"/api/states",
+	"/api/services",
+	"/api/events",
+	"/api/history",
+	"/api/logbook",
+	"/api/camera_proxy_stream",
+	"/api/camera_proxy",
+	"/api/template",
+	"/api/config",
+	"/api/hassio",
+	"/api",
+	"/auth",
+	"/static",
+	"/frontend_latest",
+	"/frontend_es5",
+	"/local",
+}
+
+func init() {
+	websocketSessions.Set(0)
+	tunnelConnected.Set(0)
+}
+
+// serveLocal serves the metrics and the health details on the metrics_listen address, which is checked to be on
+// localhost or the local network since nothing is authenticated there
+func serveLocal(address string, c *controller.Controller) {
+	metricsRegistry.NewGaugeFunc("hass_proxy_tunnel_ping_age_seconds",
+		"Seconds since the proxy last sent a ping or request through the tunnel, or -1 if it hasn't yet.", func() float64 {
+			last := atomic.LoadInt64(&lastTunnelActivity)
+			if last == 0 {
+				return -1
+			}
+
+			return time.Since(time.Unix(0, last)).Seconds()
+		})
+	metricsRegistry.NewGaugeFunc("hass_proxy_registered",
+		"Whether we have a registration to the controller, from this run or saved from an earlier one.", func() float64 {
+			if c.RealmKey() == nil {
+				return 0
+			}
+
+			return 1
+		})
+	metricsRegistry.NewGaugeFunc("hass_proxy_registration_timestamp_seconds",
+		"Unix time of the registration to the controller that is in use, or 0 if there is none.", func() float64 {
+			if c.Registered().IsZero() {
+				return 0
+			}
+
+			return float64(c.Registered().Unix())
+		})
+
+	c.SetObserver(metricsObserver{})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry)
+	mux.Handle("/_health", newHealthHandler(c, true))
+
+	logger.Infof("Serving metrics on http://%s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Error(errors.Wrap(err, "failed to serve metrics"))
+	}
+}
+
+// metricsObserver counts the verifications and registrations of the controller
+type metricsObserver struct{}
+
+func (metricsObserver) Verified(reason controller.Reason) {
+	authorizations.Inc(string(reason))
+}
+
+func (metricsObserver) Registration(err error) {
+	if err != nil {
+		registrations.Inc("failed")
+		return
+	}
+
+	registrations.Inc("ok")
+}
+
+// tunnelActivity marks that the proxy has just sent us something
+func tunnelActivity() {
+	atomic.StoreInt64(&lastTunnelActivity, time.Now().UnixNano())
+}
+
+// observeRequest counts a request that has been served
+func observeRequest(r *http.Request, status int, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	method := r.Method
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		http.MethodOptions:
+	default:
+		method = "other"
+	}
+
+	labels := []string{method, strconv.Itoa(status), pathGroup(r.URL.Path)}
+	requestsTotal.Inc(labels...)
+	requestDuration.Observe(duration.Seconds(), labels...)
+}
+
+// pathGroup returns the group that a request path is counted in
+func pathGroup(path string) string {
+	path = policy.CleanPath(path)
+	for _, group := range metricsPathGroups {
+		if path == group || strings.HasPrefix(path, group+"/") {
+			return group
+		}
+	}
+
+	return "other"
+}
+
+// statusWriter remembers the status code and size of the response, for the request metrics and the audit log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets websocket connections be upgraded through the writer
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Record is one request in the audit log, or one command sent on a WebSocket session. Commands have the method and
+// path of the session, and the status is only set for the ones that were refused, since the outcome of the others
+// isn't known when they are passed on.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Signer    string    `json:"signer,omitempty"`
+	Mandates  []Mandate `json:"mandates,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Command   string    `json:"command,omitempty"`
+	Domain    string    `json:"domain,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	Entities  []string  `json:"entities,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// Mandate is a mandate that the request was authorized with
+type Mandate struct {
+	Role     string `json:"role"`
+	RoleName string `json:"role_name,omitempty"`
+}
+
+// Log writes records to a JSONL file, which is rotated when it grows too large or too old. Rotated files are kept as
+// <file>.1, <file>.2 and so on, with <file>.1 being the newest.
+type Log struct {
+	file    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+	lock    *sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+// NewLog returns a new instance of Log that writes to file. The file is rotated before it grows beyond maxSize bytes
+// or when its first record is older than maxAge, and keep rotated files are kept. Zero disables that limit.
+func NewLog(file string, maxSize int64, maxAge time.Duration, keep int) *Log {
+	return &Log{
+		file:    file,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Write adds a record to the log
+func (l *Log) Write(record Record) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal audit record")
+	}
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if l.size > 0 && ((l.maxSize > 0 && l.size+int64(len(b)) > l.maxSize) ||
+		(l.maxAge > 0 && time.Since(l.started) > l.maxAge)) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if l.size == 0 {
+		l.started = record.Time
+	}
+
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to write audit record")
+	}
+
+	return nil
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
+
+// open opens the log file for appending, and picks up the size and age of what is already in it
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit log")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to open audit log")
+	}
+
+	l.f = f
+	l.size = info.Size()
+	l.started = time.Now()
+
+	if l.size > 0 {
+		if first, err := firstRecord(l.file); err == nil {
+			l.started = first.Time
+		}
+	}
+
+	return nil
+}
+
+// rotate moves the log file to <file>.1, shifting the older rotated files along and removing the oldest
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close audit log")
+	}
+	l.f = nil
+
+	if l.keep < 1 {
+		if err := os.Remove(l.file); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove audit log")
+		}
+	} else {
+		os.Remove(rotatedFile(l.file, l.keep))
+		for i := l.keep - 1; i > 0; i-- {
+			if err := os.Rename(rotatedFile(l.file, i), rotatedFile(l.file, i+1)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "failed to rotate audit log")
+			}
+		}
+
+		if err := os.Rename(l.file, rotatedFile(l.file, 1)); err != nil {
+			return errors.Wrap(err, "failed to rotate audit log")
+		}
+	}
+
+	return l.open()
+}
+
+func rotatedFile(file string, n int) string {
+	return fmt.Sprintf("%s.%d", file, n)
+}
+
+func firstRecord(file string) (Record, error) {
+	record := Record{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return record, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(line, &record)
+
+	return record, err
+}
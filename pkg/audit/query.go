@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Filter selects records from the audit log. Fields that are not set match every record.
+type Filter struct {
+	// User matches the signer thumbprint, or the role or role name of one of the mandates
+	User   string
+	Entity string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Match checks if a record is selected by the filter
+func (f Filter) Match(record Record) bool {
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && record.Time.After(f.Until) {
+		return false
+	}
+
+	if f.User != "" && !matchUser(record, f.User) {
+		return false
+	}
+
+	if f.Entity != "" && !matchEntity(record, f.Entity) {
+		return false
+	}
+
+	return true
+}
+
+func matchUser(record Record, user string) bool {
+	if strings.EqualFold(record.Signer, user) {
+		return true
+	}
+
+	for _, mandate := range record.Mandates {
+		if strings.EqualFold(mandate.Role, user) || strings.EqualFold(mandate.RoleName, user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchEntity(record Record, entity string) bool {
+	for _, id := range record.Entities {
+		if strings.EqualFold(id, entity) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read calls fn with every record in the audit log and its rotated files that matches the filter, oldest first
+func Read(file string, keep int, filter Filter, fn func(Record)) error {
+	files := make([]string, 0, keep+1)
+	for i := keep; i > 0; i-- {
+		files = append(files, rotatedFile(file, i))
+	}
+	files = append(files, file)
+
+	found := false
+	for _, name := range files {
+		err := readFile(name, filter, fn)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return errors.Errorf("no audit log at %s", file)
+	}
+
+	return nil
+}
+
+func readFile(file string, filter Filter, fn func(Record)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := Record{}
+		// skip lines that were cut off, like if we were stopped while writing
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+
+		if filter.Match(record) {
+			fn(record)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "failed to read %s", file)
+	}
+
+	return nil
+}
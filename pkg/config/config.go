@@ -0,0 +1,205 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Load reads the configuration. Settings are taken from, in order of precedence, command line flags, the environment
+// (and a .env file), the Hass.io add-on options file, the config file and last the defaults.
+func Load() error {
+	_ = godotenv.Load(".env")
+	viper.AutomaticEnv()
+
+	if err := loadFiles(); err != nil {
+		return err
+	}
+
+	setUpstream()
+
+	return nil
+}
+
+// loadFiles sets up the defaults and then layers the config file and the add-on options on top of them. Flags and the
+// environment are looked up by viper before any of these.
+func loadFiles() error {
+	SetDefaults()
+
+	if file := viper.GetString("config_file"); file != "" {
+		if err := applyFile(file, ""); err != nil {
+			return errors.Wrap(err, "failed to read config file")
+		}
+	}
+
+	if file := viper.GetString("options_file"); file != "" {
+		if _, err := os.Stat(file); err == nil {
+			if err := applyFile(file, "json"); err != nil {
+				return errors.Wrap(err, "failed to read add-on options")
+			}
+		}
+	}
+
+	for _, setting := range []string{"secret", "password", "key_passphrase", "identity_secret"} {
+		if err := readSecretFile(setting); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyFile reads a config file and uses its settings instead of the current defaults. The format is taken from the
+// file extension unless configType is set.
+func applyFile(file, configType string) error {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if configType != "" {
+		v.SetConfigType(configType)
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	for _, key := range v.AllKeys() {
+		value := v.Get(key)
+
+		// the add-on options have every option in them, where the ones that aren't set are empty
+		if value == nil || value == "" {
+			continue
+		}
+
+		viper.SetDefault(key, value)
+	}
+
+	return nil
+}
+
+// readSecretFile reads a setting from the file named by the <setting>_file setting, unless the setting itself is set.
+// This keeps secrets out of the environment.
+func readSecretFile(setting string) error {
+	file := viper.GetString(setting + "_file")
+	if file == "" || viper.GetString(setting) != "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s_file", setting)
+	}
+
+	viper.SetDefault(setting, strings.TrimSpace(string(b)))
+
+	return nil
+}
+
+// SetDefaults sets the default value of every setting
+func SetDefaults() {
+	viper.SetDefault("config_file", "")
+	viper.SetDefault("options_file", "/data/options.json")
+	viper.SetDefault("log_formatter", "text")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("secret", "")
+	viper.SetDefault("secret_file", "")
+	viper.SetDefault("remote", "https://hass.svc.integrity.app/service/hass/tunnel")
+	viper.SetDefault("proxy_endpoint", "https://proxy.svc.integrity.app")
+	viper.SetDefault("local", "http://hassio/homeassistant")
+	viper.SetDefault("local_host", "hassio")
+	viper.SetDefault("username", "")
+	viper.SetDefault("password", "")
+	viper.SetDefault("password_file", "")
+	viper.SetDefault("login_file", "")
+	viper.SetDefault("key", "hass-proxy.pem")
+	viper.SetDefault("key_passphrase", "")
+	viper.SetDefault("key_passphrase_file", "")
+	viper.SetDefault("hassio_token", "")
+	viper.SetDefault("idle_timeout", "60s")
+	viper.SetDefault("request_timeout", "0")
+	viper.SetDefault("max_response_size", 16)
+	viper.SetDefault("policy_file", "")
+	viper.SetDefault("token_clock_skew", "30s")
+	viper.SetDefault("token_single_use", false)
+	viper.SetDefault("token_cache_size", 10000)
+	viper.SetDefault("revocation_url", "")
+	viper.SetDefault("revocation_file", "")
+	viper.SetDefault("revocation_refresh", "5m")
+	viper.SetDefault("registration_file", "")
+	viper.SetDefault("registration_refresh", "1h")
+	viper.SetDefault("controller_key", "")
+	viper.SetDefault("realm_key", "")
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("notify_offline", false)
+	viper.SetDefault("metrics_listen", "")
+	viper.SetDefault("audit_file", "")
+	viper.SetDefault("audit_max_size", 10)
+	viper.SetDefault("audit_max_age", "168h")
+	viper.SetDefault("audit_keep", 5)
+	viper.SetDefault("rate_limit", "")
+	viper.SetDefault("rate_limit_user", "")
+	viper.SetDefault("rate_limit_role", "")
+	viper.SetDefault("rate_limit_failed", "")
+	viper.SetDefault("max_requests_per_user", 0)
+	viper.SetDefault("max_websockets_per_user", 0)
+	viper.SetDefault("identity_secret", "")
+	viper.SetDefault("identity_secret_file", "")
+	viper.SetDefault("identity_header_prefix", "X-Hass-Proxy-")
+	viper.SetDefault("identity_params", "")
+	viper.SetDefault("users_file", "")
+	viper.SetDefault("users_required", false)
+	viper.SetDefault("auth_debug", false)
+}
+
+// Secret splits the secret setting into its binding and secret parts
+func Secret() (string, string, error) {
+	parts := strings.SplitN(viper.GetString("secret"), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("secret should be written as <binding>.<secret>")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// RevocationURL returns where the revocation list is loaded from, which defaults to /revocations on the controller
+func RevocationURL() string {
+	if u := viper.GetString("revocation_url"); u != "" {
+		return u
+	}
+
+	return strings.TrimSuffix(viper.GetString("remote"), "/") + "/revocations"
+}
+
+// RevocationFile returns where the revocation list is saved, which defaults to next to the key file
+func RevocationFile() string {
+	return besideKey("revocation_file", "hass-proxy-revocations.json")
+}
+
+// RegistrationFile returns where the controller registration is saved, which defaults to next to the key file
+func RegistrationFile() string {
+	return besideKey("registration_file", "hass-proxy-registration.json")
+}
+
+// UsersFile returns where the Home Assistant users that realm users are mapped to are kept, which defaults to next to
+// the key file
+func UsersFile() string {
+	return besideKey("users_file", "hass-proxy-users.json")
+}
+
+// LoginFile returns where the refresh token we get by logging in to Home Assistant with the password is kept, which
+// defaults to next to the key file
+func LoginFile() string {
+	return besideKey("login_file", "hass-proxy-login.json")
+}
+
+func besideKey(setting, name string) string {
+	if f := viper.GetString(setting); f != "" {
+		return f
+	}
+
+	return filepath.Join(filepath.Dir(viper.GetString("key")), name)
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+)
+
+// Reload reads the config files again and validates the result. If the files can't be read or the configuration has
+// errors, the current configuration is kept.
+func Reload() (Problems, error) {
+	saved := viper.AllSettings()
+
+	err := loadFiles()
+	if err != nil {
+		restore(saved)
+		return nil, err
+	}
+
+	problems := Validate()
+	if len(problems.Errors()) > 0 {
+		restore(saved)
+		return problems, nil
+	}
+
+	setUpstream()
+
+	return problems, nil
+}
+
+// restore puts back the settings from before a reload. The environment still takes precedence over them, just like
+// it did when they were read.
+func restore(saved map[string]interface{}) {
+	for key, value := range saved {
+		viper.SetDefault(key, value)
+	}
+}
+
+// WatchedFiles returns the files that the configuration is read from, which should be watched for changes
+func WatchedFiles() []string {
+	files := make([]string, 0)
+	for _, setting := range []string{"config_file", "options_file", "secret_file", "password_file", "key_passphrase_file", "identity_secret_file", "policy_file"} {
+		if file := viper.GetString(setting); file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
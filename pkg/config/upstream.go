@@ -0,0 +1,80 @@
+package config
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Upstream holds the settings for reaching Home Assistant that are used while serving requests
+type Upstream struct {
+	URL         string
+	Host        string
+	Token       string
+	IdleTimeout time.Duration
+	// responses that aren't WebSockets have to be complete within RequestTimeout, if it is set, and at most
+	// MaxResponseSize bytes
+	RequestTimeout  time.Duration
+	MaxResponseSize int64
+	// the identity of the caller is passed on in headers starting with IdentityPrefix, signed with IdentitySecret
+	IdentitySecret string
+	IdentityPrefix string
+	IdentityParams []string
+}
+
+// requests read the upstream settings from this copy, which is only replaced as a whole, since viper itself can't be
+// read while the configuration is being reloaded
+var (
+	upstreamLock = &sync.RWMutex{}
+	upstream     Upstream
+)
+
+// CurrentUpstream returns the upstream settings of the current configuration
+func CurrentUpstream() Upstream {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+
+	return upstream
+}
+
+func setUpstream() {
+	u := Upstream{
+		URL:             viper.GetString("local"),
+		Host:            viper.GetString("local_host"),
+		Token:           viper.GetString("hassio_token"),
+		IdleTimeout:     viper.GetDuration("idle_timeout"),
+		RequestTimeout:  viper.GetDuration("request_timeout"),
+		MaxResponseSize: viper.GetInt64("max_response_size") * 1024 * 1024,
+		IdentitySecret:  viper.GetString("identity_secret"),
+		IdentityPrefix:  http.CanonicalHeaderKey(viper.GetString("identity_header_prefix")),
+		IdentityParams:  identityParams(viper.Get("identity_params")),
+	}
+
+	upstreamLock.Lock()
+	upstream = u
+	upstreamLock.Unlock()
+}
+
+// identityParams reads the list of mandate params, which is either a comma separated string or a list
+func identityParams(v interface{}) []string {
+	params := make([]string, 0)
+
+	var list []string
+	if s, ok := v.(string); ok {
+		list = strings.Split(s, ",")
+	} else {
+		list = cast.ToStringSlice(v)
+	}
+
+	for _, param := range list {
+		if param = strings.TrimSpace(param); param != "" {
+			params = append(params, param)
+		}
+	}
+
+	return params
+}
@@ -0,0 +1,323 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/Brickchain/hass-proxy/pkg/limit"
+	"github.com/Brickchain/hass-proxy/pkg/policy"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Problem is something wrong with a setting. Warnings are reported but don't keep the proxy from starting.
+type Problem struct {
+	Setting string
+	Message string
+	Warning bool
+}
+
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Setting, p.Message)
+}
+
+// Problems is the list of everything that is wrong with the configuration
+type Problems []Problem
+
+// Errors returns the problems that are not just warnings
+func (p Problems) Errors() Problems {
+	errs := make(Problems, 0)
+	for _, problem := range p {
+		if !problem.Warning {
+			errs = append(errs, problem)
+		}
+	}
+
+	return errs
+}
+
+// Warnings returns the problems that are just warnings
+func (p Problems) Warnings() Problems {
+	warnings := make(Problems, 0)
+	for _, problem := range p {
+		if problem.Warning {
+			warnings = append(warnings, problem)
+		}
+	}
+
+	return warnings
+}
+
+// Validate checks every setting and returns all the problems it finds, without connecting anywhere
+func Validate() Problems {
+	v := &validator{problems: make(Problems, 0)}
+
+	v.logging()
+	v.credentials()
+
+	v.url("remote", true)
+	v.url("proxy_endpoint", true)
+	v.url("local", true)
+	v.url("revocation_url", false)
+
+	v.duration("idle_timeout", true)
+	v.duration("request_timeout", false)
+	v.duration("token_clock_skew", false)
+	v.duration("revocation_refresh", true)
+	v.duration("registration_refresh", true)
+	v.duration("shutdown_timeout", true)
+	v.duration("audit_max_age", false)
+
+	if viper.GetBool("token_single_use") && viper.GetInt("token_cache_size") < 1 {
+		v.errorf("token_cache_size", "has to be at least 1 when token_single_use is set")
+	}
+
+	if size, err := cast.ToInt64E(viper.Get("max_response_size")); err != nil || size < 1 {
+		v.errorf("max_response_size", "should be a size in megabytes")
+	}
+
+	v.localAddress("metrics_listen")
+
+	v.rate("rate_limit")
+	v.rate("rate_limit_user")
+	v.rate("rate_limit_role")
+	v.rate("rate_limit_failed")
+	v.count("max_requests_per_user")
+	v.count("max_websockets_per_user")
+
+	if viper.GetString("identity_secret") != "" && viper.GetString("identity_header_prefix") == "" {
+		v.errorf("identity_header_prefix", "has to be set when identity_secret is set")
+	}
+
+	v.thumbprint("controller_key")
+	v.thumbprint("realm_key")
+
+	v.keyFile()
+	v.policyFile()
+	v.auditFile()
+
+	return v.problems
+}
+
+type validator struct {
+	problems Problems
+}
+
+func (v *validator) errorf(setting, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Setting: setting,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) warnf(setting, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Setting: setting,
+		Message: fmt.Sprintf(format, args...),
+		Warning: true,
+	})
+}
+
+func (v *validator) logging() {
+	if _, err := logrus.ParseLevel(viper.GetString("log_level")); err != nil {
+		v.errorf("log_level", "unknown log level %q", viper.GetString("log_level"))
+	}
+
+	switch viper.GetString("log_formatter") {
+	case "text", "json", "dev":
+	default:
+		v.errorf("log_formatter", "should be one of text, json or dev")
+	}
+}
+
+func (v *validator) credentials() {
+	if viper.GetString("secret") != "" {
+		if _, _, err := Secret(); err != nil {
+			v.errorf("secret", "should be written as <binding>.<secret>")
+		}
+
+		return
+	}
+
+	if viper.GetString("password") == "" {
+		v.errorf("secret", "either secret or password has to be set")
+		return
+	}
+
+	// with a password the controller gets a Home Assistant access token, which we only hand over to a controller that
+	// has proven who it is
+	if viper.GetString("controller_key") == "" && viper.GetString("realm_key") == "" {
+		v.errorf("controller_key", "controller_key or realm_key has to be set when password is used")
+	}
+}
+
+func (v *validator) url(setting string, required bool) {
+	s := viper.GetString(setting)
+	if s == "" {
+		if required {
+			v.errorf(setting, "has to be set")
+		}
+
+		return
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		v.errorf(setting, "is not a valid URL: %s", err)
+		return
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.errorf(setting, "should be an http:// or https:// URL")
+		return
+	}
+
+	if u.Host == "" {
+		v.errorf(setting, "has no host")
+	}
+}
+
+func (v *validator) duration(setting string, positive bool) {
+	d, err := cast.ToDurationE(viper.Get(setting))
+	if err != nil {
+		v.errorf(setting, "is not a valid duration, use something like 30s or 5m")
+		return
+	}
+
+	if d < 0 || (positive && d == 0) {
+		v.errorf(setting, "has to be longer than 0")
+	}
+}
+
+// localAddress checks that a listen address is on localhost or the local network, since what is served there is not
+// authenticated
+func (v *validator) localAddress(setting string) {
+	s := viper.GetString(setting)
+	if s == "" {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || port == "" {
+		v.errorf(setting, "should be written as <address>:<port>")
+		return
+	}
+
+	if host == "localhost" {
+		return
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !(ip.IsLoopback() || isPrivate(ip) || ip.IsLinkLocalUnicast()) {
+		v.errorf(setting, "has to be a loopback or local network address, like 127.0.0.1:9102")
+	}
+}
+
+// private networks from RFC 1918 and RFC 4193. net.IP.IsPrivate does the same, but needs a newer Go than we build with.
+var privateNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		_, n, err := net.ParseCIDR(network)
+		if err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *validator) rate(setting string) {
+	if _, err := limit.ParseRate(viper.GetString(setting)); err != nil {
+		v.errorf(setting, "%s", err)
+	}
+}
+
+func (v *validator) count(setting string) {
+	if n, err := cast.ToIntE(viper.Get(setting)); err != nil || n < 0 {
+		v.errorf(setting, "should be a number, or 0 for no limit")
+	}
+}
+
+func (v *validator) thumbprint(setting string) {
+	s := viper.GetString(setting)
+	if s == "" {
+		return
+	}
+
+	if b, err := hex.DecodeString(s); err != nil || len(b) != 32 {
+		v.errorf(setting, "should be a hex encoded SHA-256 key thumbprint")
+	}
+}
+
+func (v *validator) keyFile() {
+	file := viper.GetString("key")
+	if file == "" {
+		v.errorf("key", "has to be set")
+		return
+	}
+
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		// the key is created on the first run, so the directory has to be there
+		if dir, err := os.Stat(filepath.Dir(file)); err != nil || !dir.IsDir() {
+			v.errorf("key", "directory %s does not exist", filepath.Dir(file))
+		}
+
+		return
+	}
+
+	if err != nil {
+		v.errorf("key", "can't read key file: %s", err)
+		return
+	}
+
+	if info.IsDir() {
+		v.errorf("key", "%s is a directory", file)
+		return
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		v.warnf("key", "%s is readable by group or other users (mode %s), it should be 0600", file, info.Mode().Perm())
+	}
+}
+
+func (v *validator) policyFile() {
+	file := viper.GetString("policy_file")
+	if file == "" {
+		return
+	}
+
+	if err := policy.NewEngine().LoadFile(file); err != nil {
+		v.errorf("policy_file", "%s", err)
+	}
+}
+
+func (v *validator) auditFile() {
+	file := viper.GetString("audit_file")
+	if file == "" {
+		return
+	}
+
+	if dir, err := os.Stat(filepath.Dir(file)); err != nil || !dir.IsDir() {
+		v.errorf("audit_file", "directory %s does not exist", filepath.Dir(file))
+	}
+
+	if size, err := cast.ToInt64E(viper.Get("audit_max_size")); err != nil || size < 0 {
+		v.errorf("audit_max_size", "should be a size in megabytes, or 0 to not rotate by size")
+	}
+
+	if keep, err := cast.ToIntE(viper.Get("audit_keep")); err != nil || keep < 0 {
+		v.errorf("audit_keep", "should be the number of rotated files to keep")
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// settingsOf returns the sorted settings that problems are about
+func settingsOf(problems Problems) []string {
+	settings := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		settings = append(settings, problem.Setting)
+	}
+	sort.Strings(settings)
+
+	return settings
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hass-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "hass-proxy.pem")
+	if err := ioutil.WriteFile(key, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	openKey := filepath.Join(dir, "open.pem")
+	if err := ioutil.WriteFile(openKey, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	thumbprint := "8a6e4f1d2c3b5a69788796a5b4c3d2e1f0a1b2c3d4e5f60718293a4b5c6d7e8f"
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		errors   []string
+		warnings []string
+	}{
+		{"valid", nil, []string{}, []string{}},
+		{"no credentials", map[string]interface{}{"secret": ""}, []string{"secret"}, []string{}},
+		{"broken secret", map[string]interface{}{"secret": "binding"}, []string{"secret"}, []string{}},
+		{"password without pinned keys", map[string]interface{}{"secret": "", "password": "pw"}, []string{"controller_key"}, []string{}},
+		{"password with pinned controller", map[string]interface{}{"secret": "", "password": "pw", "controller_key": thumbprint}, []string{}, []string{}},
+		{"password with pinned realm", map[string]interface{}{"secret": "", "password": "pw", "realm_key": thumbprint}, []string{}, []string{}},
+		{"broken thumbprint", map[string]interface{}{"realm_key": "abc"}, []string{"realm_key"}, []string{}},
+		{"key readable by others", map[string]interface{}{"key": openKey}, []string{}, []string{"key"}},
+		{"key in missing directory", map[string]interface{}{"key": filepath.Join(dir, "missing", "hass-proxy.pem")}, []string{"key"}, []string{}},
+		{"every problem is collected", map[string]interface{}{
+			"log_level":       "loud",
+			"remote":          "ftp://controller.example",
+			"local":           "",
+			"idle_timeout":    "0s",
+			"request_timeout": "soon",
+			"rate_limit":      "10",
+			"metrics_listen":  "8.8.8.8:9102",
+			"key":             openKey,
+		}, []string{"idle_timeout", "local", "log_level", "metrics_listen", "rate_limit", "remote", "request_timeout"}, []string{"key"}},
+		{"single use without cache", map[string]interface{}{"token_single_use": true, "token_cache_size": 0}, []string{"token_cache_size"}, []string{}},
+		{"identity without prefix", map[string]interface{}{"identity_secret": "s", "identity_header_prefix": ""}, []string{"identity_header_prefix"}, []string{}},
+	}
+
+	for _, test := range tests {
+		viper.Reset()
+		SetDefaults()
+		viper.Set("secret", "binding.secret")
+		viper.Set("key", key)
+		for setting, value := range test.settings {
+			viper.Set(setting, value)
+		}
+
+		problems := Validate()
+		if errs := settingsOf(problems.Errors()); !reflect.DeepEqual(errs, test.errors) {
+			t.Errorf("%s: errors for %v, want %v: %v", test.name, errs, test.errors, problems)
+		}
+
+		if warnings := settingsOf(problems.Warnings()); !reflect.DeepEqual(warnings, test.warnings) {
+			t.Errorf("%s: warnings for %v, want %v", test.name, warnings, test.warnings)
+		}
+
+		if len(problems) != len(test.errors)+len(test.warnings) {
+			t.Errorf("%s: %d problems, want %d", test.name, len(problems), len(test.errors)+len(test.warnings))
+		}
+	}
+
+	viper.Reset()
+}
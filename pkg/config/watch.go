@@ -0,0 +1,106 @@
+package config
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// how long to wait for more changes before reloading, since editors often write a file in several steps
+const watchDelay = time.Millisecond * 500
+
+// Watcher calls a function when any of a set of files changes. The directories of the files are watched rather than
+// the files themselves, so that files that are replaced instead of written to are still picked up.
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	lock    *sync.Mutex
+	files   map[string]bool
+	dirs    map[string]bool
+}
+
+// NewWatcher returns a new instance of Watcher
+func NewWatcher() (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create file watcher")
+	}
+
+	return &Watcher{
+		watcher: watcher,
+		lock:    &sync.Mutex{},
+		files:   make(map[string]bool),
+		dirs:    make(map[string]bool),
+	}, nil
+}
+
+// SetFiles replaces the files that are watched
+func (w *Watcher) SetFiles(files []string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.files = make(map[string]bool)
+	for _, file := range files {
+		file = filepath.Clean(file)
+		w.files[file] = true
+
+		dir := filepath.Dir(file)
+		if w.dirs[dir] {
+			continue
+		}
+
+		if err := w.watcher.Add(dir); err != nil {
+			return errors.Wrapf(err, "failed to watch %s", dir)
+		}
+		w.dirs[dir] = true
+	}
+
+	return nil
+}
+
+// Run calls onChange after the watched files have changed, until Close is called
+func (w *Watcher) Run(onChange func()) {
+	var timer *time.Timer
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op == fsnotify.Chmod || !w.watching(event.Name) {
+				continue
+			}
+
+			logger.Debugf("%s changed", event.Name)
+
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(watchDelay, onChange)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			logger.Warn(errors.Wrap(err, "error watching config files"))
+		}
+	}
+}
+
+// Close stops watching the files
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) watching(file string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.files[filepath.Clean(file)]
+}
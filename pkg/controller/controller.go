@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	crypto "github.com/Brickchain/go-crypto.v2"
@@ -18,10 +21,30 @@ import (
 
 // Controller manages the connection to the Brickchain HASS Controller
 type Controller struct {
-	version  string
-	url      string
-	realmKey *jose.JsonWebKey
-	roles    []string
+	version   string
+	url       string
+	client    *http.Client
+	realmKey  *jose.JsonWebKey
+	roles     []string
+	audience  string
+	clockSkew time.Duration
+	replay    *replayCache
+	revoked   *Revocations
+	// lock protects the realm key and roles, which are replaced when we register while requests are being verified
+	lock       *sync.RWMutex
+	cacheFile  string
+	registered time.Time
+	// registeredURL is the URL of the tunnel we last registered with
+	registeredURL string
+	refresh       chan struct{}
+	// credentials are what we register to the controller with, and can be replaced while running
+	credentials Credentials
+	observer    Observer
+	// trusted is set when the realm key comes from a registration that was signed by a controller we trust
+	trusted bool
+	// thumbprints of the controller and realm keys we trust, if pinned
+	pinnedController string
+	pinnedRealm      string
 }
 
 // NewController returns a new instance of Controller
@@ -29,179 +52,306 @@ func NewController(url string, version string) *Controller {
 	return &Controller{
 		version: version,
 		url:     url,
+		// the registration is retried by Run, so a controller that hangs shouldn't hold it up
+		client: &http.Client{
+			Timeout: time.Second * 15,
+		},
+		lock:    &sync.RWMutex{},
+		refresh: make(chan struct{}, 1),
+	}
+}
+
+// SetAudience sets the hostname that mandate tokens must be issued for. Tokens with another URI are rejected.
+// If the hostname changes we re-register to the controller so that it knows where to find us.
+func (c *Controller) SetAudience(hostname string) {
+	if c.Audience() == hostname {
+		return
+	}
+
+	c.lock.Lock()
+	changed := c.audience != "" && c.audience != hostname
+	c.audience = hostname
+	c.lock.Unlock()
+
+	if changed {
+		logger.Infof("Hostname changed to %s", hostname)
+		c.Refresh()
+	}
+}
+
+// Audience returns the hostname that mandate tokens must be issued for
+func (c *Controller) Audience() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.audience
+}
+
+// SetClockSkew sets how far off the clock of the token issuer is allowed to be when checking timestamps
+func (c *Controller) SetClockSkew(skew time.Duration) {
+	c.lock.Lock()
+	c.clockSkew = skew
+	c.lock.Unlock()
+}
+
+func (c *Controller) skew() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.clockSkew
+}
+
+// SetSingleUse makes every mandate token usable only once. The last size tokens are remembered until they expire.
+func (c *Controller) SetSingleUse(size int) {
+	if size < 1 {
+		c.replay = nil
+		return
+	}
+
+	c.replay = newReplayCache(size)
+}
+
+// SetRevocations sets the revocation list that mandates and certificates are checked against. The revocation list
+// is verified with the same trust in the controller as the registration.
+func (c *Controller) SetRevocations(revocations *Revocations) {
+	c.revoked = revocations
+	if revocations != nil {
+		revocations.controller = c
 	}
 }
 
 // Register registers to the Brickchain HASS Controller which sends back what public key and mandate roles to trust
-func (c *Controller) Register(ourURL, binding, secret string) error {
+func (c *Controller) Register(ourURL string, credentials Credentials) error {
 	req := TunnelRegistrationRequest{
 		Version: c.version,
-		Binding: binding,
-		Secret:  secret,
 		URL:     ourURL,
 	}
 
+	if credentials == nil {
+		return errors.New("no credentials to register with")
+	}
+
+	if err := credentials.Apply(&req); err != nil {
+		return errors.Wrap(err, "failed to get credentials for registration")
+	}
+
 	reqBytes, err := json.Marshal(req)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal request")
 	}
 
-	res, err := http.Post(c.url, "application/json", bytes.NewBuffer(reqBytes))
+	res, err := c.client.Post(c.url, "application/json", bytes.NewBuffer(reqBytes))
 	if err != nil {
 		return errors.Wrap(err, "failed to register to controller")
 	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return errors.Wrap(err, "failed to read response body")
 	}
 
-	response := TunnelRegistrationResponse{}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return errors.Wrap(err, "failed to unmarshal response body")
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("controller responded with %s", res.Status)
 	}
 
-	c.realmKey = response.RealmKey
-	c.roles = response.Roles
-
-	return nil
-}
-
-// Verify checks if an http request has the Authorization header with a mandate-token that matches the realm and mandate roles
-// that the Brickchain HASS Controller told us about
-func (c *Controller) Verify(req *http.Request) bool {
-	signer, token, err := parseMandateToken(req)
+	response, verified, err := c.parseRegistration(body)
 	if err != nil {
-		logger.Error(err)
-		return false
+		return untrustedError{err}
 	}
 
-	for _, mandate := range parseMandates(token) {
-		if crypto.Thumbprint(mandate.Signer) == crypto.Thumbprint(c.realmKey) {
-			if crypto.Thumbprint(signer) == crypto.Thumbprint(mandate.Mandate.Recipient) {
-				for _, role := range c.roles {
-					if role == mandate.Mandate.Role {
-						return true
-					}
-				}
-			}
-		}
+	if response.RealmKey == nil {
+		return errors.New("no realm key in registration response")
 	}
 
-	return false
+	c.setRegistration(response, ourURL, verified, time.Now().UTC())
+
+	if err := c.saveCache(response); err != nil {
+		logger.Warn(err)
+	}
+
+	return nil
 }
 
-func parseMandateToken(req *http.Request) (*jose.JsonWebKey, *document.MandateToken, error) {
+// parseMandateToken verifies the mandate token in the Authorization header of a request, and returns the key of its
+// signer, the token and the hash of the token for the replay cache
+func (c *Controller) parseMandateToken(req *http.Request) (*jose.JsonWebKey, *document.MandateToken, string, error) {
 	a := req.Header.Get("Authorization")
 
 	var l = strings.Split(a, " ")
 
+	if a == "" {
+		return nil, nil, "", rejected(ReasonNoToken, errors.New("no auth header"))
+	}
+
 	if len(l) < 2 {
-		return nil, nil, errors.New("broken auth header")
+		return nil, nil, "", errors.New("broken auth header")
 	}
 
 	if strings.ToUpper(l[0]) != "MANDATE" {
-		return nil, nil, errors.New("unknown auth method")
+		return nil, nil, "", errors.New("unknown auth method")
 	}
 
 	tokenJWS, err := crypto.UnmarshalSignature([]byte(l[1]))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to unmarshal JWS")
+		return nil, nil, "", errors.Wrap(err, "failed to unmarshal JWS")
 	}
 
 	if len(tokenJWS.Signatures) < 1 || tokenJWS.Signatures[0].Header.JsonWebKey == nil {
-		return nil, nil, errors.New("no jwk in token")
+		return nil, nil, "", errors.New("no jwk in token")
 	}
 
 	payload, err := tokenJWS.Verify(tokenJWS.Signatures[0].Header.JsonWebKey)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to verify token")
+		return nil, nil, "", errors.Wrap(err, "failed to verify token")
 	}
 
 	token := &document.MandateToken{}
 	err = json.Unmarshal(payload, &token)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to unmarshal token")
+		return nil, nil, "", errors.Wrap(err, "failed to unmarshal token")
 	}
 
 	userKey := tokenJWS.Signatures[0].Header.JsonWebKey
 
-	if token.Timestamp.Add(time.Second * time.Duration(token.TTL)).Before(time.Now().UTC()) {
-		return nil, nil, errors.New("Token has expired")
+	now := time.Now().UTC()
+	expires := token.Timestamp.Add(time.Second * time.Duration(token.TTL))
+
+	if expires.Add(c.skew()).Before(now) {
+		return nil, nil, "", rejected(ReasonExpired, errors.New("Token has expired"))
+	}
+
+	if token.Timestamp.After(now.Add(c.skew())) {
+		return nil, nil, "", rejected(ReasonNotYetValid, errors.New("Token is issued in the future"))
+	}
+
+	if audience := c.Audience(); audience != "" && !matchesAudience(token.URI, audience) {
+		return nil, nil, "", rejected(ReasonWrongAudience, errors.Errorf("Token is issued for %s, not for us", token.URI))
 	}
 
 	if token.Certificate != "" {
+		if c.chainRevoked(token.Certificate) {
+			return nil, nil, "", rejected(ReasonRevoked, errors.New("Certificate in token has been revoked"))
+		}
+
 		certChain, err := crypto.VerifyCertificate(token.Certificate, 100)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "failed to verify certificate chain in mandate")
+			return nil, nil, "", errors.Wrap(err, "failed to verify certificate chain in mandate")
 		}
 
 		userKey = certChain.Issuer
 	}
 
-	return userKey, token, nil
+	return userKey, token, crypto.Sha256(l[1]), nil
 }
 
-func parseMandates(token *document.MandateToken) []httphandler.AuthenticatedMandate {
-	mandates := make([]httphandler.AuthenticatedMandate, 0)
+// parseMandate verifies the signature, validity and certificate chain of a mandate
+func (c *Controller) parseMandate(mandateString string) (httphandler.AuthenticatedMandate, error) {
+	if c.revoked.Revoked(mandateString) {
+		return httphandler.AuthenticatedMandate{}, rejected(ReasonRevoked, errors.New("Mandate has been revoked"))
+	}
 
-	for _, mandateString := range token.Mandates {
-		mandateJWS, err := crypto.UnmarshalSignature([]byte(mandateString))
-		if err != nil {
-			logger.Debug(errors.Wrap(err, "failed to unmarshal mandate"))
-			continue
-		}
+	mandateJWS, err := crypto.UnmarshalSignature([]byte(mandateString))
+	if err != nil {
+		return httphandler.AuthenticatedMandate{}, errors.Wrap(err, "failed to unmarshal mandate")
+	}
 
-		if len(mandateJWS.Signatures) < 1 {
-			logger.Debug(errors.New("No signers of mandate"))
-			continue
-		}
+	if len(mandateJWS.Signatures) < 1 {
+		return httphandler.AuthenticatedMandate{}, errors.New("No signers of mandate")
+	}
 
-		mandatePayload, err := mandateJWS.Verify(mandateJWS.Signatures[0].Header.JsonWebKey)
-		if err != nil {
-			logger.Debug(errors.Wrap(err, "failed to verify mandate signature"))
-			continue
+	mandatePayload, err := mandateJWS.Verify(mandateJWS.Signatures[0].Header.JsonWebKey)
+	if err != nil {
+		return httphandler.AuthenticatedMandate{}, errors.Wrap(err, "failed to verify mandate signature")
+	}
+
+	var mandate *document.Mandate
+	err = json.Unmarshal(mandatePayload, &mandate)
+	if err != nil {
+		return httphandler.AuthenticatedMandate{}, errors.Wrap(err, "failed to unmarshal mandate")
+	}
+
+	if mandate.ValidFrom == nil || mandate.Timestamp.After(time.Now().UTC().Add(c.skew())) {
+		return httphandler.AuthenticatedMandate{}, rejected(ReasonNotYetValid, errors.New("Mandate is not yet valid"))
+	}
+
+	if mandate.ValidFrom != nil && mandate.ValidFrom.After(time.Now().UTC().Add(c.skew())) {
+		return httphandler.AuthenticatedMandate{}, rejected(ReasonNotYetValid, errors.New("Mandate is not yet valid"))
+	}
+
+	if mandate.ValidUntil != nil && mandate.ValidUntil.Add(c.skew()).Before(time.Now().UTC()) {
+		return httphandler.AuthenticatedMandate{}, rejected(ReasonExpired, errors.New("Mandate has expired"))
+	}
+
+	signingKey := mandateJWS.Signatures[0].Header.JsonWebKey
+
+	if mandate.GetCertificate() != "" {
+		if c.chainRevoked(mandate.GetCertificate()) {
+			return httphandler.AuthenticatedMandate{}, rejected(ReasonRevoked, errors.New("Certificate of mandate has been revoked"))
 		}
 
-		var mandate *document.Mandate
-		err = json.Unmarshal(mandatePayload, &mandate)
+		chain, err := crypto.VerifyCertificate(mandate.GetCertificate(), 10)
 		if err != nil {
-			logger.Debug(errors.Wrap(err, "failed to unmarshal mandate"))
-			continue
+			return httphandler.AuthenticatedMandate{}, errors.Wrap(err, "could not verify certificate chain")
 		}
 
-		if mandate.ValidFrom == nil || mandate.Timestamp.After(time.Now().UTC()) {
-			logger.Debug(errors.New("Mandate is not yet valid"))
-			continue
-		}
+		signingKey = chain.Issuer
+	}
+
+	return httphandler.AuthenticatedMandate{
+		Mandate: mandate,
+		Signer:  signingKey,
+	}, nil
+}
 
-		if mandate.ValidFrom != nil && mandate.ValidFrom.After(time.Now().UTC()) {
-			logger.Debug(errors.New("Mandate is not yet valid"))
-			continue
+// chainRevoked checks if any of the certificates in a certificate chain has been revoked
+func (c *Controller) chainRevoked(chain string) bool {
+	if c.revoked == nil {
+		return false
+	}
+
+	for chain != "" {
+		if c.revoked.Revoked(chain) {
+			return true
 		}
 
-		if mandate.ValidUntil != nil && mandate.ValidUntil.Before(time.Now().UTC()) {
-			logger.Debug("Mandate has expired")
-			continue
+		// a broken chain is rejected when it is verified, here we only care about revocations
+		cert, err := crypto.VerifyCertificate(chain, 100)
+		if err != nil {
+			return false
 		}
 
-		signingKey := mandateJWS.Signatures[0].Header.JsonWebKey
+		chain = cert.Certificate
+	}
 
-		if mandate.GetCertificate() != "" {
-			chain, err := crypto.VerifyCertificate(mandate.GetCertificate(), 10)
-			if err != nil {
-				logger.Debug(errors.Wrap(err, "could not verify certificate chain"))
-				continue
-			}
+	return false
+}
+
+// matchesAudience checks that the URI of a mandate token points at our hostname. The URI can either be a full URL or
+// just the hostname.
+func matchesAudience(uri, hostname string) bool {
+	if uri == "" {
+		return false
+	}
 
-			signingKey = chain.Issuer
+	return strings.EqualFold(uriHost(uri), uriHost(hostname))
+}
+
+// uriHost returns the hostname part of a URL or host:port string
+func uriHost(uri string) string {
+	host := uri
+	if strings.Contains(uri, "://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return ""
 		}
 
-		mandates = append(mandates, httphandler.AuthenticatedMandate{
-			Mandate: mandate,
-			Signer:  signingKey,
-		})
+		host = u.Host
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
 
-	return mandates
+	return host
 }
@@ -0,0 +1,46 @@
+package controller
+
+// Credentials is how we prove to the Brickchain HASS Controller that we are allowed to register for a Home Assistant
+// installation
+type Credentials interface {
+	Apply(req *TunnelRegistrationRequest) error
+}
+
+// SecretCredentials authenticates with the binding and secret set up in the Home Assistant administration interface
+type SecretCredentials struct {
+	Binding string
+	Secret  string
+}
+
+// Apply sets the binding and secret on the registration request
+func (s SecretCredentials) Apply(req *TunnelRegistrationRequest) error {
+	req.Binding = s.Binding
+	req.Secret = s.Secret
+
+	return nil
+}
+
+// TokenSource returns a Home Assistant access token that is valid for the given URL
+type TokenSource interface {
+	Token(clientID string) (string, error)
+}
+
+// TokenCredentials authenticates with a Home Assistant access token, which the controller can use to check that we
+// control the Home Assistant installation behind our URL. It is used when there is no pre-shared secret. The token is
+// a bearer token with the rights of the Home Assistant user it was issued to, and is sent to the controller on every
+// registration.
+type TokenCredentials struct {
+	Source TokenSource
+}
+
+// Apply gets an access token for our URL and sets it on the registration request
+func (t TokenCredentials) Apply(req *TunnelRegistrationRequest) error {
+	token, err := t.Source.Token(req.URL + "/")
+	if err != nil {
+		return err
+	}
+
+	req.AccessToken = token
+
+	return nil
+}
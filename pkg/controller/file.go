@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// writeFileAtomic writes to a temporary file first and then moves it into place, so that we never leave a half written
+// file behind
+func writeFileAtomic(file string, b []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write temporary file")
+	}
+	tmp.Close()
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to set file permissions")
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to move file into place")
+	}
+
+	return nil
+}
@@ -1,13 +1,20 @@
 package controller
 
-import jose "gopkg.in/square/go-jose.v1"
+import (
+	"time"
+
+	document "github.com/Brickchain/go-document.v2"
+	jose "gopkg.in/square/go-jose.v1"
+)
 
 // TunnelRegistrationRequest is the message we send to the Brickchain HASS Controller in order to tell it about our existence
 type TunnelRegistrationRequest struct {
-	Version string `json:"version"`
-	Binding string `json:"binding"`
-	Secret  string `json:"secret"`
-	URL     string `json:"url"`
+	Version     string `json:"version"`
+	Binding     string `json:"binding"`
+	Secret      string `json:"secret"`
+	URL         string `json:"url"`
+	AccessToken string `json:"accessToken,omitempty"`
+	Offline     bool   `json:"offline,omitempty"`
 }
 
 // TunnelRegistrationResponse is the response we get from the Brickchain HASS Controller that contains the public key of the realm
@@ -16,3 +23,25 @@ type TunnelRegistrationResponse struct {
 	RealmKey *jose.JsonWebKey `json:"realmKey"`
 	Roles    []string         `json:"roles"`
 }
+
+// RevocationList is the list of revoked mandates and certificates that we get from the Brickchain HASS Controller.
+// The checksum of every revocation is a RevocationChecksum document, signed by the key that issued what it revokes.
+type RevocationList struct {
+	Revocations []*document.Revocation `json:"revocations"`
+	Updated     time.Time              `json:"updated,omitempty"`
+}
+
+// SignedRevocationList is a RevocationList signed by the key of the Brickchain HASS Controller, with the controller
+// binding like in SignedTunnelRegistrationResponse
+type SignedRevocationList struct {
+	JWS     string `json:"jws"`
+	Binding string `json:"binding,omitempty"`
+}
+
+// SignedTunnelRegistrationResponse is a TunnelRegistrationResponse signed by the key of the Brickchain HASS Controller.
+// Binding is the controller binding signed by the realm, which holds the certificate the realm has issued to the
+// controller key.
+type SignedTunnelRegistrationResponse struct {
+	JWS     string `json:"jws"`
+	Binding string `json:"binding,omitempty"`
+}
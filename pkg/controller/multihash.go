@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// revocation checksums are SHA-256 multihashes, written in base58 like the rest of the Brickchain documents
+const (
+	multihashSHA256 = 0x12
+	multihashLength = sha256.Size
+	base58Alphabet  = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+// RevocationChecksum returns the multihash that a signed mandate or certificate is revoked by
+func RevocationChecksum(jws string) string {
+	sum := sha256.Sum256([]byte(jws))
+	return base58Encode(append([]byte{multihashSHA256, multihashLength}, sum[:]...))
+}
+
+// parseMultihash checks that a revocation checksum is a SHA-256 multihash, and returns it in the form that
+// RevocationChecksum returns
+func parseMultihash(s string) (string, error) {
+	b, err := base58Decode(s)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) != 2+multihashLength || b[0] != multihashSHA256 || b[1] != multihashLength {
+		return "", errors.New("checksum is not a SHA-256 multihash")
+	}
+
+	return base58Encode(b), nil
+}
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	out := make([]byte, 0, len(b)*138/100+1)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+
+	// leading zero bytes are written as leading ones
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty checksum")
+	}
+
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, errors.Errorf("invalid base58 character %q in checksum", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
@@ -0,0 +1,36 @@
+package controller
+
+// Observer is told about the outcome of verifications and registrations, like for collecting metrics
+type Observer interface {
+	// Verified is called with the reason for every request checked by Verify
+	Verified(reason Reason)
+	// Registration is called after every attempt to register to the controller, with the error if it failed
+	Registration(err error)
+}
+
+// SetObserver sets the observer that is told about verifications and registrations
+func (c *Controller) SetObserver(observer Observer) {
+	c.lock.Lock()
+	c.observer = observer
+	c.lock.Unlock()
+}
+
+func (c *Controller) verified(reason Reason) {
+	c.lock.RLock()
+	observer := c.observer
+	c.lock.RUnlock()
+
+	if observer != nil {
+		observer.Verified(reason)
+	}
+}
+
+func (c *Controller) registration(err error) {
+	c.lock.RLock()
+	observer := c.observer
+	c.lock.RUnlock()
+
+	if observer != nil {
+		observer.Registration(err)
+	}
+}
@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// backoff limits when registration to the controller keeps failing
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute * 5
+)
+
+// registrationCache is what we save to disk after registering, so that we can start without the controller
+type registrationCache struct {
+	TunnelRegistrationResponse
+	Registered time.Time `json:"registered"`
+	Verified   bool      `json:"verified,omitempty"`
+	// URL is the URL of the tunnel we registered with
+	URL string `json:"url,omitempty"`
+}
+
+// SetCacheFile sets the file where the last registration response is saved
+func (c *Controller) SetCacheFile(file string) {
+	c.cacheFile = file
+}
+
+// LoadCache reads the registration response saved by an earlier run, so that we can verify mandates before we have
+// been able to register to the controller. It is not an error if there is no saved registration.
+func (c *Controller) LoadCache() error {
+	if c.cacheFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.cacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return errors.Wrap(err, "failed to read registration file")
+	}
+
+	cache := registrationCache{}
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return errors.Wrap(err, "failed to unmarshal registration file")
+	}
+
+	if cache.RealmKey == nil {
+		return errors.New("no realm key in registration file")
+	}
+
+	c.lock.RLock()
+	pinnedRealm := c.pinnedRealm
+	c.lock.RUnlock()
+
+	if pinnedRealm != "" && crypto.Thumbprint(cache.RealmKey) != pinnedRealm {
+		return errors.New("realm key in registration file does not match the pinned realm key")
+	}
+
+	c.setRegistration(cache.TunnelRegistrationResponse, cache.URL, cache.Verified, cache.Registered)
+
+	logger.Infof("Using registration to the controller from %s", cache.Registered.Format(time.RFC3339))
+
+	return nil
+}
+
+// Registered returns when we last registered to the controller, or the zero time if we haven't
+func (c *Controller) Registered() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.registered
+}
+
+// RegisteredURL returns the URL of the tunnel that we last registered to the controller with
+func (c *Controller) RegisteredURL() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.registeredURL
+}
+
+// Verified tells if the realm key comes from a registration that was signed by a controller we trust, either pinned
+// with controller_key or certified by a realm key we already trusted
+func (c *Controller) Verified() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.trusted
+}
+
+// RealmKey returns the realm key from the last registration, or nil if we haven't registered
+func (c *Controller) RealmKey() *jose.JsonWebKey {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.realmKey
+}
+
+// Roles returns the mandate roles from the last registration
+func (c *Controller) Roles() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.roles
+}
+
+// SetCredentials sets the credentials we register to the controller with, which are used from the next registration
+func (c *Controller) SetCredentials(credentials Credentials) {
+	c.lock.Lock()
+	c.credentials = credentials
+	c.lock.Unlock()
+}
+
+func (c *Controller) currentCredentials() Credentials {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.credentials
+}
+
+// Run registers to the controller and then keeps the registration up to date by registering again on every interval,
+// and whenever Refresh is called. Failed registrations are retried with a backoff, and in the meantime we keep
+// using the realm key and roles from the last successful registration.
+func (c *Controller) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.registerWithBackoff()
+
+		select {
+		case <-ticker.C:
+		case <-c.refresh:
+		}
+	}
+}
+
+// Unregister tells the controller that we are going offline, so that it can stop sending users our way. It sends the
+// same request as Register, marked as offline.
+func (c *Controller) Unregister(ourURL string) error {
+	req := TunnelRegistrationRequest{
+		Version: c.version,
+		URL:     ourURL,
+		Offline: true,
+	}
+
+	credentials := c.currentCredentials()
+	if credentials == nil {
+		return errors.New("no credentials to unregister with")
+	}
+
+	if err := credentials.Apply(&req); err != nil {
+		return errors.Wrap(err, "failed to get credentials for unregistering")
+	}
+
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request")
+	}
+
+	// we are shutting down, so don't wait long for the controller
+	client := &http.Client{Timeout: time.Second * 5}
+	res, err := client.Post(c.url, "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return errors.Wrap(err, "failed to unregister from controller")
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("controller responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// Refresh makes Run register to the controller again right away
+func (c *Controller) Refresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// registerWithBackoff tries to register to the controller until it succeeds, waiting longer after every failure
+func (c *Controller) registerWithBackoff() {
+	backoff := minBackoff
+
+	for {
+		// the hostname can change while we are retrying, so we build our URL on every attempt
+		err := c.Register(fmt.Sprintf("https://%s", c.Audience()), c.currentCredentials())
+		c.registration(err)
+		if err == nil {
+			logger.Info("Registered to the controller")
+			return
+		}
+
+		// add some jitter so that a controller outage doesn't make everyone come back at the same time
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if _, ok := err.(untrustedError); ok {
+			logger.Errorf("Refusing registration from an untrusted controller, retrying in %s: %s", wait.Round(time.Second), err)
+		} else {
+			logger.Warningf("Failed to register to the controller, retrying in %s: %s", wait.Round(time.Second), err)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-c.refresh:
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Controller) setRegistration(response TunnelRegistrationResponse, ourURL string, verified bool, registered time.Time) {
+	c.lock.Lock()
+	c.realmKey = response.RealmKey
+	c.registeredURL = ourURL
+	c.trusted = verified
+	c.roles = response.Roles
+	c.registered = registered
+	c.lock.Unlock()
+}
+
+func (c *Controller) saveCache(response TunnelRegistrationResponse) error {
+	if c.cacheFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(registrationCache{
+		TunnelRegistrationResponse: response,
+		Registered:                 c.Registered(),
+		Verified:                   c.Verified(),
+		URL:                        c.RegisteredURL(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal registration")
+	}
+
+	return errors.Wrap(writeFileAtomic(c.cacheFile, b, 0600), "failed to save registration file")
+}
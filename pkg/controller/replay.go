@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// replayCache remembers the hashes of the tokens we have already seen, until they expire. It is bounded in size and
+// forgets the oldest tokens first when it is full.
+type replayCache struct {
+	lock  *sync.Mutex
+	size  int
+	seen  map[string]*list.Element
+	order *list.List
+}
+
+type replayEntry struct {
+	hash    string
+	expires time.Time
+}
+
+func newReplayCache(size int) *replayCache {
+	return &replayCache{
+		lock:  &sync.Mutex{},
+		size:  size,
+		seen:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// check returns true if the hash has been seen before, otherwise it is remembered until it expires
+func (c *replayCache) check(hash string, expires time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	if e, ok := c.seen[hash]; ok {
+		if e.Value.(*replayEntry).expires.After(now) {
+			return true
+		}
+
+		c.order.Remove(e)
+		delete(c.seen, hash)
+	}
+
+	// forget expired tokens, and the oldest ones if we are still full
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		entry := e.Value.(*replayEntry)
+		if entry.expires.After(now) && c.order.Len() < c.size {
+			break
+		}
+
+		c.order.Remove(e)
+		delete(c.seen, entry.hash)
+	}
+
+	c.seen[hash] = c.order.PushBack(&replayEntry{
+		hash:    hash,
+		expires: expires,
+	})
+
+	return false
+}
+
+// used returns true if the hash has been seen before and hasn't expired yet, without remembering it
+func (c *replayCache) used(hash string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.seen[hash]
+	return ok && e.Value.(*replayEntry).expires.After(time.Now())
+}
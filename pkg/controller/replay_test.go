@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	document "github.com/Brickchain/go-document.v2"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// replayStep checks a hash against the replay cache, and whether it should have been seen before
+type replayStep struct {
+	hash    string
+	expires time.Time
+	seen    bool
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	later, earlier := now.Add(time.Hour), now.Add(-time.Second)
+
+	tests := []struct {
+		name  string
+		size  int
+		steps []replayStep
+	}{
+		{"seen once", 2, []replayStep{
+			{"a", later, false},
+			{"a", later, true},
+			{"b", later, false},
+			{"a", later, true},
+		}},
+		{"oldest is forgotten when full", 2, []replayStep{
+			{"a", later, false},
+			{"b", later, false},
+			{"c", later, false},
+			{"a", later, false},
+			{"c", later, true},
+		}},
+		{"expired are forgotten before live ones", 2, []replayStep{
+			{"a", earlier, false},
+			{"b", later, false},
+			{"c", later, false},
+			{"b", later, true},
+			{"c", later, true},
+		}},
+		{"expired is not seen", 2, []replayStep{
+			{"a", earlier, false},
+			{"a", later, false},
+			{"a", later, true},
+		}},
+	}
+
+	for _, test := range tests {
+		c := newReplayCache(test.size)
+		for i, step := range test.steps {
+			if seen := c.check(step.hash, step.expires); seen != step.seen {
+				t.Errorf("%s: step %d: check(%s) = %v, want %v", test.name, i+1, step.hash, seen, step.seen)
+			}
+		}
+
+		if c.order.Len() > test.size || len(c.seen) != c.order.Len() {
+			t.Errorf("%s: cache holds %d entries in order and %d by hash, with size %d", test.name, c.order.Len(), len(c.seen), test.size)
+		}
+	}
+}
+
+func TestReplayCacheUsed(t *testing.T) {
+	c := newReplayCache(2)
+
+	if c.used("a") {
+		t.Error("used should be false for a hash that hasn't been seen")
+	}
+
+	if c.used("a") || c.check("a", time.Now().Add(time.Hour)) {
+		t.Error("used should not remember the hash")
+	}
+
+	if !c.used("a") {
+		t.Error("used should be true for a hash that has been seen")
+	}
+
+	c.check("b", time.Now().Add(-time.Second))
+	if c.used("b") {
+		t.Error("used should be false for a hash that has expired")
+	}
+}
+
+type testKeys struct {
+	realm, user *jose.JsonWebKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	realm, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testKeys{realm: realm, user: user}
+}
+
+func sign(t *testing.T, key *jose.JsonWebKey, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := crypto.NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// token returns a mandate token for the role, signed by the user and with a mandate issued by the realm
+func (k testKeys) token(t *testing.T, role, uri string, issued time.Time) *http.Request {
+	recipient, err := crypto.NewPublicKey(k.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mandate := document.NewMandate(role)
+	mandate.Recipient = recipient
+
+	token := document.NewMandateToken([]string{sign(t, k.realm, mandate)}, uri, 60)
+	token.Timestamp = issued
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Mandate "+sign(t, k.user, token))
+
+	return req
+}
+
+func newTestController(t *testing.T, keys testKeys, roles ...string) *Controller {
+	realmKey, err := crypto.NewPublicKey(keys.realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewController("", "test")
+	c.setRegistration(TunnelRegistrationResponse{RealmKey: realmKey, Roles: roles}, "https://tunnel.example", false, time.Now())
+	c.SetAudience("tunnel.example")
+	c.SetSingleUse(10)
+
+	return c
+}
+
+// TestVerifyReplayOrder checks that tokens are only remembered once they are accepted, so that a token that is
+// rejected for another reason can still be used once that reason is gone
+func TestVerifyReplayOrder(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now().UTC()
+
+	admin := keys.token(t, "admin@realm", "https://tunnel.example", now)
+	guest := keys.token(t, "guest@realm", "https://tunnel.example", now)
+	expired := keys.token(t, "admin@realm", "https://tunnel.example", now.Add(-time.Hour))
+
+	c := newTestController(t, keys, "admin@realm")
+
+	tests := []struct {
+		name   string
+		before func()
+		req    *http.Request
+		record bool
+		reason Reason
+	}{
+		{"expired", nil, expired, true, ReasonExpired},
+		{"expired again", nil, expired, true, ReasonExpired},
+		{"wrong audience", func() { c.SetAudience("other.example") }, admin, true, ReasonWrongAudience},
+		{"right audience", func() { c.SetAudience("tunnel.example") }, admin, true, ReasonOK},
+		{"replayed", nil, admin, true, ReasonReplayed},
+		{"unknown role", nil, guest, true, ReasonNoMatchingMandate},
+		{"unknown role again", nil, guest, true, ReasonNoMatchingMandate},
+		{"health check", func() { c.roles = []string{"admin@realm", "guest@realm"} }, guest, false, ReasonOK},
+		{"health check again", nil, guest, false, ReasonOK},
+		{"known role", nil, guest, true, ReasonOK},
+		{"known role replayed", nil, guest, true, ReasonReplayed},
+		{"health check replayed", nil, guest, false, ReasonReplayed},
+	}
+
+	for _, test := range tests {
+		if test.before != nil {
+			test.before()
+		}
+
+		result := c.verify(test.req, test.record)
+		if result.Reason != test.reason {
+			t.Errorf("%s: reason %s, want %s", test.name, result.Reason, test.reason)
+		}
+
+		if result.OK() != (test.reason == ReasonOK) {
+			t.Errorf("%s: %d accepted mandates with reason %s", test.name, len(result.Mandates), result.Reason)
+		}
+	}
+}
+
+// TestVerifyReplayEviction checks that rejected tokens can't push accepted ones out of a full cache
+func TestVerifyReplayEviction(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now().UTC()
+
+	c := newTestController(t, keys, "admin@realm")
+	c.SetSingleUse(1)
+
+	admin := keys.token(t, "admin@realm", "https://tunnel.example", now)
+	if result := c.Verify(admin); result.Reason != ReasonOK {
+		t.Fatalf("first use: reason %s", result.Reason)
+	}
+
+	for i := 0; i < 3; i++ {
+		if result := c.Verify(keys.token(t, "guest@realm", "https://tunnel.example", now)); result.Reason != ReasonNoMatchingMandate {
+			t.Fatalf("rejected token %d: reason %s", i+1, result.Reason)
+		}
+	}
+
+	if result := c.Verify(admin); result.Reason != ReasonReplayed {
+		t.Errorf("accepted token was forgotten, reason %s", result.Reason)
+	}
+
+	// an accepted token does take the place of the oldest one
+	if result := c.Verify(keys.token(t, "admin@realm", "https://tunnel.example", now)); result.Reason != ReasonOK {
+		t.Fatalf("second token: reason %s", result.Reason)
+	}
+
+	if result := c.Verify(admin); result.Reason != ReasonOK {
+		t.Errorf("oldest token should have been forgotten, reason %s", result.Reason)
+	}
+}
@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	document "github.com/Brickchain/go-document.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/pkg/errors"
+)
+
+// Revocations keeps the set of revoked mandates and certificates. It is loaded from the Brickchain HASS Controller and
+// saved to disk, so that revocations still apply when the controller can't be reached.
+type Revocations struct {
+	url  string
+	file string
+	lock *sync.RWMutex
+	// revoked holds the revocations by the checksum of what they revoke
+	revoked map[string]*document.Revocation
+	updated time.Time
+	// controller is what revocation lists are verified with, set by Controller.SetRevocations
+	controller *Controller
+	client     *http.Client
+	stopChan   chan struct{}
+}
+
+// NewRevocations returns a new instance of Revocations that loads the revocation list from url and keeps a copy in file
+func NewRevocations(url, file string) *Revocations {
+	return &Revocations{
+		url:     url,
+		file:    file,
+		lock:    &sync.RWMutex{},
+		revoked: make(map[string]*document.Revocation),
+		client: &http.Client{
+			Timeout: time.Second * 15,
+		},
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Revoked checks if a signed mandate or certificate has been revoked
+func (r *Revocations) Revoked(jws string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.revoked[RevocationChecksum(jws)]
+	return ok
+}
+
+// Updated returns when the revocation list was last updated by the controller
+func (r *Revocations) Updated() time.Time {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.updated
+}
+
+// Load reads the last known revocation list from disk
+func (r *Revocations) Load() error {
+	b, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return errors.Wrap(err, "failed to read revocation file")
+	}
+
+	list := RevocationList{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.Wrap(err, "failed to unmarshal revocation file")
+	}
+
+	r.set(list, false)
+
+	return nil
+}
+
+// Refresh loads the revocation list from the controller and saves it to disk. A list that is signed by a controller we
+// trust replaces the current one, unless it is older. A list that can't be verified, because no controller or realm
+// key is trusted yet, can only add revocations, so that whoever sent it can't take any away.
+func (r *Revocations) Refresh() error {
+	if r.controller == nil {
+		return errors.New("no controller to verify revocations with")
+	}
+
+	res, err := r.client.Get(r.url)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch revocations from controller")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller responded with %s when fetching revocations", res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response body")
+	}
+
+	list, verified, err := r.controller.parseRevocations(body)
+	if err != nil {
+		return err
+	}
+
+	if !verified {
+		logger.Warn("Revocation list is not signed by a trusted controller, only adding to the known revocations; set controller_key or realm_key to verify it")
+	} else if !list.Updated.IsZero() && list.Updated.Before(r.Updated()) {
+		return errors.Errorf("revocation list from %s is older than the current one", list.Updated.Format(time.RFC3339))
+	}
+
+	if list.Updated.IsZero() {
+		list.Updated = time.Now().UTC()
+	}
+
+	return r.save(r.set(list, !verified))
+}
+
+// Run refreshes the revocation list on every interval until Stop is called
+func (r *Revocations) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Refresh(); err != nil {
+			logger.Warn(errors.Wrap(err, "failed to refresh revocations, using the last known list"))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// Stop stops the refresh loop started by Run
+func (r *Revocations) Stop() {
+	close(r.stopChan)
+}
+
+// set applies a revocation list, either replacing the current revocations or adding to them, and returns the list of
+// revocations that now apply. Revocations that aren't signed or don't hold a checksum are left out.
+func (r *Revocations) set(list RevocationList, merge bool) RevocationList {
+	revoked := make(map[string]*document.Revocation)
+	for _, revocation := range list.Revocations {
+		checksum, err := revocationChecksum(revocation)
+		if err != nil {
+			logger.Warn(errors.Wrap(err, "ignoring revocation"))
+			continue
+		}
+
+		revoked[checksum] = revocation
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if merge {
+		for checksum, revocation := range r.revoked {
+			revoked[checksum] = revocation
+		}
+	}
+
+	r.revoked = revoked
+	if list.Updated.After(r.updated) || !merge {
+		r.updated = list.Updated
+	}
+
+	applied := RevocationList{
+		Revocations: make([]*document.Revocation, 0, len(revoked)),
+		Updated:     r.updated,
+	}
+	for _, revocation := range revoked {
+		applied.Revocations = append(applied.Revocations, revocation)
+	}
+
+	return applied
+}
+
+// revocationChecksum returns the checksum that a revocation revokes, after checking the signature of its
+// RevocationChecksum document
+func revocationChecksum(revocation *document.Revocation) (string, error) {
+	if revocation == nil || revocation.Checksum == nil || len(revocation.Checksum.Signatures) < 1 ||
+		revocation.Checksum.Signatures[0].Header.JsonWebKey == nil {
+		return "", errors.New("revocation has no signed checksum")
+	}
+
+	payload, err := revocation.Checksum.Verify(revocation.Checksum.Signatures[0].Header.JsonWebKey)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to verify revocation checksum")
+	}
+
+	checksum := document.RevocationChecksum{}
+	if err := json.Unmarshal(payload, &checksum); err != nil {
+		return "", errors.Wrap(err, "failed to unmarshal revocation checksum")
+	}
+
+	return parseMultihash(checksum.Multihash)
+}
+
+func (r *Revocations) save(list RevocationList) error {
+	b, err := json.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal revocations")
+	}
+
+	return errors.Wrap(writeFileAtomic(r.file, b, 0600), "failed to save revocation file")
+}
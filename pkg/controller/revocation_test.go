@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	document "github.com/Brickchain/go-document.v2"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// revoke returns a revocation of a signed mandate or certificate, with the checksum signed by key
+func revoke(t *testing.T, key *jose.JsonWebKey, jws string) *document.Revocation {
+	checksum, err := crypto.UnmarshalSignature([]byte(sign(t, key, document.NewRevocationChecksum(RevocationChecksum(jws)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return document.NewRevocation(checksum)
+}
+
+func certificate(t *testing.T, issuer, subject *jose.JsonWebKey, chain string) string {
+	subjectKey, err := crypto.NewPublicKey(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := crypto.CreateCertificate(issuer, subjectKey, 1, nil, 3600, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// chainToken returns a mandate token with one mandate, where the token is signed by device with a certificate chain
+// for it, and the mandate is issued to recipient by mandateSigner with an optional certificate chain of its own
+func chainToken(t *testing.T, mandateSigner, recipient, device *jose.JsonWebKey, mandateChain, tokenChain string) (*http.Request, string) {
+	recipientKey, err := crypto.NewPublicKey(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mandate := document.NewMandate("admin@realm")
+	mandate.Recipient = recipientKey
+	mandate.Certificate = mandateChain
+	signed := sign(t, mandateSigner, mandate)
+
+	token := document.NewMandateToken([]string{signed}, "https://tunnel.example", 60)
+	token.Certificate = tokenChain
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Mandate "+sign(t, device, token))
+
+	return req, signed
+}
+
+func newTestKey(t *testing.T) *jose.JsonWebKey {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestVerifyRevoked(t *testing.T) {
+	keys := newTestKeys(t)
+	issuer, mid, device := newTestKey(t), newTestKey(t), newTestKey(t)
+
+	// the realm has given issuer a certificate to issue mandates with, and the user has given a certificate to mid,
+	// which has given one to the device that signs the token
+	issuerCert := certificate(t, keys.realm, issuer, "")
+	midCert := certificate(t, keys.user, mid, "")
+	deviceCert := certificate(t, mid, device, midCert)
+
+	plain, plainMandate := chainToken(t, keys.realm, keys.user, keys.user, "", "")
+	issued, issuedMandate := chainToken(t, issuer, keys.user, keys.user, issuerCert, "")
+	chained, _ := chainToken(t, keys.realm, mid, device, "", deviceCert)
+
+	tests := []struct {
+		name    string
+		revoked []*document.Revocation
+		req     *http.Request
+		reason  Reason
+	}{
+		{"nothing revoked", nil, plain, ReasonOK},
+		{"mandate", []*document.Revocation{revoke(t, keys.realm, plainMandate)}, plain, ReasonNoMatchingMandate},
+		{"other mandate", []*document.Revocation{revoke(t, keys.realm, issuedMandate)}, plain, ReasonOK},
+		{"mandate with certificate", nil, issued, ReasonOK},
+		{"mandate issued with certificate", []*document.Revocation{revoke(t, issuer, issuedMandate)}, issued, ReasonNoMatchingMandate},
+		{"certificate of mandate", []*document.Revocation{revoke(t, keys.realm, issuerCert)}, issued, ReasonNoMatchingMandate},
+		{"token with certificate chain", nil, chained, ReasonOK},
+		{"certificate of token", []*document.Revocation{revoke(t, mid, deviceCert)}, chained, ReasonRevoked},
+		{"certificate further up the chain", []*document.Revocation{revoke(t, keys.user, midCert)}, chained, ReasonRevoked},
+		{"certificate in another chain", []*document.Revocation{revoke(t, keys.realm, issuerCert)}, chained, ReasonOK},
+	}
+
+	for _, test := range tests {
+		c := newTestController(t, keys, "admin@realm")
+		r := NewRevocations("", "")
+		r.set(RevocationList{Revocations: test.revoked, Updated: time.Now().UTC()}, false)
+		c.SetRevocations(r)
+
+		result := c.VerifyWithoutRecording(test.req)
+		if result.Reason != test.reason {
+			t.Errorf("%s: reason %s, want %s: %s", test.name, result.Reason, test.reason, result.Message())
+		}
+
+		// a revoked mandate is rejected on its own, the token is only rejected if its certificate is revoked
+		if test.reason == ReasonNoMatchingMandate && (len(result.Results) != 1 || result.Results[0].Reason != ReasonRevoked) {
+			t.Errorf("%s: mandate results %+v, want the mandate to be revoked", test.name, result.Results)
+		}
+	}
+}
+
+func TestRevocationsSet(t *testing.T) {
+	key := newTestKey(t)
+
+	unsigned := document.NewRevocation(nil)
+	a, b := sign(t, key, document.NewMandate("a@realm")), sign(t, key, document.NewMandate("b@realm"))
+
+	r := NewRevocations("", "")
+	applied := r.set(RevocationList{Revocations: []*document.Revocation{revoke(t, key, a), unsigned}}, false)
+
+	if len(applied.Revocations) != 1 || !r.Revoked(a) || r.Revoked(b) {
+		t.Fatalf("%d revocations applied, a revoked %v, b revoked %v", len(applied.Revocations), r.Revoked(a), r.Revoked(b))
+	}
+
+	// an unverified list only adds to the known revocations
+	r.set(RevocationList{Revocations: []*document.Revocation{revoke(t, key, b)}}, true)
+	if !r.Revoked(a) || !r.Revoked(b) {
+		t.Fatalf("after merging a revoked %v, b revoked %v, want both", r.Revoked(a), r.Revoked(b))
+	}
+
+	// a verified list replaces them
+	r.set(RevocationList{Revocations: []*document.Revocation{revoke(t, key, b)}}, false)
+	if r.Revoked(a) || !r.Revoked(b) {
+		t.Errorf("after replacing a revoked %v, b revoked %v, want only b", r.Revoked(a), r.Revoked(b))
+	}
+
+	var none *Revocations
+	if none.Revoked(a) {
+		t.Error("nil revocations should not revoke anything")
+	}
+}
@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	document "github.com/Brickchain/go-document.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// untrustedError is returned when the registration response doesn't come from a controller we trust
+type untrustedError struct {
+	error
+}
+
+// SetPinnedKeys sets the thumbprints of the controller key and realm key that we trust. When any of them are set the
+// registration response has to be signed by the controller, and registration fails if the keys don't match.
+func (c *Controller) SetPinnedKeys(controllerThumbprint, realmThumbprint string) {
+	c.lock.Lock()
+	c.pinnedController = strings.ToLower(controllerThumbprint)
+	c.pinnedRealm = strings.ToLower(realmThumbprint)
+	c.lock.Unlock()
+}
+
+// parseRegistration reads the registration response from the controller and checks that it comes from a controller we
+// trust. Signed responses are trusted if they are signed by the pinned controller key, or by a controller key that a
+// realm we already trust has issued a certificate to in the controller binding. The realm is trusted if it is pinned,
+// or if an earlier registration was verified. Without either, the response can't be verified and it is only accepted
+// as unverified, which is what the returned bool tells.
+func (c *Controller) parseRegistration(body []byte) (TunnelRegistrationResponse, bool, error) {
+	response := TunnelRegistrationResponse{}
+
+	c.lock.RLock()
+	pinnedController, pinnedRealm := c.pinnedController, c.pinnedRealm
+	c.lock.RUnlock()
+	trustedRealm := c.trustedRealm()
+
+	signed := SignedTunnelRegistrationResponse{}
+	if err := json.Unmarshal(body, &signed); err != nil || signed.JWS == "" {
+		if pinnedController != "" || trustedRealm != "" {
+			return response, false, errors.New("registration response is not signed by the controller")
+		}
+
+		logger.Warn("Registration response is not signed and can't be verified, set controller_key or realm_key to require a signed response")
+
+		if err := json.Unmarshal(body, &response); err != nil {
+			return response, false, errors.Wrap(err, "failed to unmarshal response body")
+		}
+
+		return response, false, nil
+	}
+
+	payload, controllerKey, err := parseControllerJWS(signed.JWS)
+	if err != nil {
+		return response, false, errors.Wrap(err, "failed to verify registration")
+	}
+
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return response, false, errors.Wrap(err, "failed to unmarshal registration")
+	}
+
+	if response.RealmKey == nil {
+		return response, false, errors.New("no realm key in registration response")
+	}
+
+	if pinnedRealm != "" && crypto.Thumbprint(response.RealmKey) != pinnedRealm {
+		return response, false, errors.Errorf("realm key %s does not match the pinned realm key", crypto.Thumbprint(response.RealmKey))
+	}
+
+	if pinnedController != "" {
+		if crypto.Thumbprint(controllerKey) != pinnedController {
+			return response, false, errors.Errorf("registration is signed by %s, not by the pinned controller key", crypto.Thumbprint(controllerKey))
+		}
+
+		return response, true, nil
+	}
+
+	// the realm key comes from the same response as the binding, so the binding only proves anything if we already
+	// trust that realm key
+	if trustedRealm == "" {
+		logger.Warn("Registration response is signed, but there is no trusted realm key to verify the controller binding with, set controller_key or realm_key to verify it")
+		return response, false, nil
+	}
+
+	if crypto.Thumbprint(response.RealmKey) != trustedRealm {
+		return response, false, errors.Errorf("realm key %s does not match the realm key of the earlier verified registration", crypto.Thumbprint(response.RealmKey))
+	}
+
+	if err := verifyBinding(signed.Binding, response.RealmKey, controllerKey); err != nil {
+		return response, false, errors.Wrap(err, "failed to verify controller binding")
+	}
+
+	return response, true, nil
+}
+
+// trustedRealm returns the thumbprint of the realm key we trust, which is the pinned one, or else the one from an
+// earlier registration that was verified. It is empty if we don't trust any realm key yet.
+func (c *Controller) trustedRealm() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.pinnedRealm != "" {
+		return c.pinnedRealm
+	}
+
+	if c.trusted && c.realmKey != nil {
+		return crypto.Thumbprint(c.realmKey)
+	}
+
+	return ""
+}
+
+// parseControllerJWS verifies the signature of a JWS sent by the controller, and returns its payload and the key it is
+// signed with. Whether that key belongs to a controller we trust is up to the caller.
+func parseControllerJWS(signed string) ([]byte, *jose.JsonWebKey, error) {
+	jws, err := crypto.UnmarshalSignature([]byte(signed))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to unmarshal JWS")
+	}
+
+	if len(jws.Signatures) < 1 || jws.Signatures[0].Header.JsonWebKey == nil {
+		return nil, nil, errors.New("no jwk in JWS")
+	}
+
+	controllerKey := jws.Signatures[0].Header.JsonWebKey
+
+	payload, err := jws.Verify(controllerKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to verify signature")
+	}
+
+	return payload, controllerKey, nil
+}
+
+// parseRevocations reads a revocation list from the controller and checks that it comes from a controller we trust,
+// the same way as parseRegistration does, using the realm key of the current registration. Lists that can't be
+// verified because we don't trust any controller or realm key yet are returned as unverified, which is what the
+// returned bool tells.
+func (c *Controller) parseRevocations(body []byte) (RevocationList, bool, error) {
+	list := RevocationList{}
+
+	c.lock.RLock()
+	pinnedController, realmKey := c.pinnedController, c.realmKey
+	c.lock.RUnlock()
+	trustedRealm := c.trustedRealm()
+
+	signed := SignedRevocationList{}
+	if err := json.Unmarshal(body, &signed); err != nil || signed.JWS == "" {
+		if pinnedController != "" || trustedRealm != "" {
+			return list, false, errors.New("revocation list is not signed by the controller")
+		}
+
+		if err := json.Unmarshal(body, &list); err != nil {
+			return list, false, errors.Wrap(err, "failed to unmarshal revocations")
+		}
+
+		return list, false, nil
+	}
+
+	payload, controllerKey, err := parseControllerJWS(signed.JWS)
+	if err != nil {
+		return list, false, errors.Wrap(err, "failed to verify revocation list")
+	}
+
+	if err := json.Unmarshal(payload, &list); err != nil {
+		return list, false, errors.Wrap(err, "failed to unmarshal revocations")
+	}
+
+	if pinnedController != "" {
+		if crypto.Thumbprint(controllerKey) != pinnedController {
+			return list, false, errors.Errorf("revocation list is signed by %s, not by the pinned controller key", crypto.Thumbprint(controllerKey))
+		}
+
+		return list, true, nil
+	}
+
+	if trustedRealm == "" {
+		return list, false, nil
+	}
+
+	if realmKey == nil || crypto.Thumbprint(realmKey) != trustedRealm {
+		return list, false, errors.New("not registered with the trusted realm key, can't verify the revocation list")
+	}
+
+	if err := verifyBinding(signed.Binding, realmKey, controllerKey); err != nil {
+		return list, false, errors.Wrap(err, "failed to verify controller binding of revocation list")
+	}
+
+	return list, true, nil
+}
+
+// verifyBinding checks that the controller binding is signed by the realm, and that it holds a certificate from the
+// realm for the controller key
+func verifyBinding(bindingJWS string, realmKey, controllerKey *jose.JsonWebKey) error {
+	if bindingJWS == "" {
+		return errors.New("no controller binding in registration response")
+	}
+
+	jws, err := crypto.UnmarshalSignature([]byte(bindingJWS))
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal binding JWS")
+	}
+
+	if len(jws.Signatures) < 1 || jws.Signatures[0].Header.JsonWebKey == nil {
+		return errors.New("no jwk in binding JWS")
+	}
+
+	signer := jws.Signatures[0].Header.JsonWebKey
+	if crypto.Thumbprint(signer) != crypto.Thumbprint(realmKey) {
+		return errors.New("binding is not signed by the realm")
+	}
+
+	payload, err := jws.Verify(signer)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify binding signature")
+	}
+
+	binding := document.ControllerBinding{}
+	if err := json.Unmarshal(payload, &binding); err != nil {
+		return errors.Wrap(err, "failed to unmarshal binding")
+	}
+
+	if binding.RealmDescriptor != nil && binding.RealmDescriptor.PublicKey != nil &&
+		crypto.Thumbprint(binding.RealmDescriptor.PublicKey) != crypto.Thumbprint(realmKey) {
+		return errors.New("realm descriptor in binding does not match the realm key")
+	}
+
+	if binding.ControllerCertificate == "" {
+		return errors.New("no controller certificate in binding")
+	}
+
+	cert, err := crypto.VerifyCertificate(binding.ControllerCertificate, 100)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify controller certificate")
+	}
+
+	if cert.Issuer == nil || crypto.Thumbprint(cert.Issuer) != crypto.Thumbprint(realmKey) {
+		return errors.New("controller certificate is not issued by the realm")
+	}
+
+	if cert.Subject == nil || crypto.Thumbprint(cert.Subject) != crypto.Thumbprint(controllerKey) {
+		return errors.New("controller certificate is not issued to the key that signed the registration")
+	}
+
+	return nil
+}
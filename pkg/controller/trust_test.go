@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	document "github.com/Brickchain/go-document.v2"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// binding returns a controller binding signed by the realm, with a certificate from the realm for the controller key
+func binding(t *testing.T, realm, controller *jose.JsonWebKey) string {
+	b := document.NewControllerBinding(nil)
+	b.ControllerCertificate = certificate(t, realm, controller, "")
+
+	return sign(t, realm, b)
+}
+
+func marshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestParseRegistration(t *testing.T) {
+	realm, otherRealm := newTestKey(t), newTestKey(t)
+	controller, otherController := newTestKey(t), newTestKey(t)
+
+	realmKey, err := crypto.NewPublicKey(realm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRealmKey, err := crypto.NewPublicKey(otherRealm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := TunnelRegistrationResponse{RealmKey: realmKey, Roles: []string{"admin@realm"}}
+	otherResponse := TunnelRegistrationResponse{RealmKey: otherRealmKey, Roles: []string{"admin@realm"}}
+
+	unsigned := marshal(t, response)
+	signed := marshal(t, SignedTunnelRegistrationResponse{JWS: sign(t, controller, response)})
+	bound := marshal(t, SignedTunnelRegistrationResponse{JWS: sign(t, controller, response), Binding: binding(t, realm, controller)})
+	byOther := marshal(t, SignedTunnelRegistrationResponse{JWS: sign(t, otherController, response), Binding: binding(t, otherRealm, otherController)})
+	otherRealmResponse := marshal(t, SignedTunnelRegistrationResponse{JWS: sign(t, controller, otherResponse), Binding: binding(t, otherRealm, controller)})
+
+	// trust sets up what the controller trusts before the registration
+	type trust func(c *Controller)
+	none := func(c *Controller) {}
+	pinController := func(c *Controller) { c.SetPinnedKeys(crypto.Thumbprint(controller), "") }
+	pinRealm := func(c *Controller) { c.SetPinnedKeys("", crypto.Thumbprint(realm)) }
+	earlier := func(c *Controller) { c.setRegistration(response, "https://tunnel.example", true, time.Now()) }
+	earlierUnverified := func(c *Controller) { c.setRegistration(response, "https://tunnel.example", false, time.Now()) }
+
+	tests := []struct {
+		name     string
+		trust    trust
+		body     []byte
+		ok       bool
+		verified bool
+	}{
+		{"unsigned without pinned keys", none, unsigned, true, false},
+		{"unsigned with pinned controller", pinController, unsigned, false, false},
+		{"unsigned with pinned realm", pinRealm, unsigned, false, false},
+		{"unsigned after a verified registration", earlier, unsigned, false, false},
+		{"unsigned after an unverified registration", earlierUnverified, unsigned, true, false},
+		{"signed without pinned keys", none, bound, true, false},
+		{"signed by pinned controller", pinController, signed, true, true},
+		{"signed by another controller", pinController, byOther, false, false},
+		{"bound to pinned realm", pinRealm, bound, true, true},
+		{"signed without binding", pinRealm, signed, false, false},
+		{"bound to another realm", pinRealm, byOther, false, false},
+		{"another realm than pinned", pinRealm, otherRealmResponse, false, false},
+		{"bound to earlier verified realm", earlier, bound, true, true},
+		{"another realm than earlier", earlier, otherRealmResponse, false, false},
+	}
+
+	for _, test := range tests {
+		c := NewController("", "test")
+		test.trust(c)
+
+		_, verified, err := c.parseRegistration(test.body)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: error %v, want ok %v", test.name, err, test.ok)
+		}
+
+		if verified != test.verified {
+			t.Errorf("%s: verified %v, want %v", test.name, verified, test.verified)
+		}
+	}
+}
+
+func TestParseRevocations(t *testing.T) {
+	keys := newTestKeys(t)
+	controller := newTestKey(t)
+
+	list := RevocationList{Updated: time.Now().UTC()}
+	unsigned := marshal(t, list)
+	bound := marshal(t, SignedRevocationList{JWS: sign(t, controller, list), Binding: binding(t, keys.realm, controller)})
+
+	tests := []struct {
+		name     string
+		pinned   string
+		body     []byte
+		ok       bool
+		verified bool
+	}{
+		{"unsigned without pinned keys", "", unsigned, true, false},
+		{"unsigned with pinned realm", crypto.Thumbprint(keys.realm), unsigned, false, false},
+		{"bound to pinned realm", crypto.Thumbprint(keys.realm), bound, true, true},
+		{"bound to another realm than pinned", crypto.Thumbprint(controller), bound, false, false},
+	}
+
+	for _, test := range tests {
+		c := newTestController(t, keys, "admin@realm")
+		c.SetPinnedKeys("", test.pinned)
+
+		_, verified, err := c.parseRevocations(test.body)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: error %v, want ok %v", test.name, err, test.ok)
+		}
+
+		if verified != test.verified {
+			t.Errorf("%s: verified %v, want %v", test.name, verified, test.verified)
+		}
+	}
+}
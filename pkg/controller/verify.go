@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// Reason tells why a mandate token or a mandate in it was accepted or rejected
+type Reason string
+
+// Reasons that a mandate token is accepted or rejected, as passed to the Observer
+const (
+	ReasonOK                Reason = "ok"
+	ReasonNoToken           Reason = "no_token"
+	ReasonInvalidToken      Reason = "invalid_token"
+	ReasonExpired           Reason = "expired"
+	ReasonNotYetValid       Reason = "not_yet_valid"
+	ReasonWrongAudience     Reason = "wrong_audience"
+	ReasonRevoked           Reason = "revoked"
+	ReasonReplayed          Reason = "replayed"
+	ReasonNotRegistered     Reason = "not_registered"
+	ReasonNoMatchingMandate Reason = "no_matching_mandate"
+)
+
+// Reasons that a single mandate in a token is rejected, besides expired, not_yet_valid and revoked
+const (
+	ReasonInvalidMandate Reason = "invalid_mandate"
+	ReasonWrongRealm     Reason = "wrong_realm"
+	ReasonWrongRecipient Reason = "wrong_recipient"
+	ReasonUnknownRole    Reason = "unknown_role"
+)
+
+// VerifyResult is the outcome of verifying the mandate token of a request
+type VerifyResult struct {
+	// Reason is ReasonOK if at least one mandate is accepted, otherwise why the token was rejected
+	Reason Reason
+	// Err describes why the token was rejected, nil when it is accepted or when only its mandates were rejected
+	Err error
+	// Signer is the key the token is signed with, or the issuer of its certificate chain
+	Signer  *jose.JsonWebKey
+	URI     string
+	Expires time.Time
+	// Mandates are the accepted mandates
+	Mandates []httphandler.AuthenticatedMandate
+	// Results tell for every mandate in the token whether it was accepted, in the order of the token
+	Results []MandateResult
+}
+
+// MandateResult is the outcome of verifying a single mandate in a token
+type MandateResult struct {
+	Role     string
+	RoleName string
+	Reason   Reason
+	Err      error
+}
+
+// Accepted tells if the mandate is accepted
+func (m MandateResult) Accepted() bool {
+	return m.Reason == ReasonOK
+}
+
+// OK tells if the token has at least one accepted mandate
+func (r *VerifyResult) OK() bool {
+	return len(r.Mandates) > 0
+}
+
+// Roles returns the roles of the accepted mandates
+func (r *VerifyResult) Roles() []string {
+	roles := make([]string, 0, len(r.Mandates))
+	for _, mandate := range r.Mandates {
+		roles = append(roles, mandate.Mandate.Role)
+	}
+
+	return roles
+}
+
+// Message describes why the token was rejected, with the reason of every mandate if none of them are accepted
+func (r *VerifyResult) Message() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+
+	if r.OK() {
+		return ""
+	}
+
+	if len(r.Results) < 1 {
+		return "Token has no mandates"
+	}
+
+	reasons := make([]string, 0, len(r.Results))
+	for i, m := range r.Results {
+		reasons = append(reasons, fmt.Sprintf("mandate %d (%s): %s", i+1, m.Role, m.Reason))
+	}
+
+	return "No mandate is accepted: " + strings.Join(reasons, ", ")
+}
+
+// Verify checks the Authorization header of an http request for a mandate-token with mandates that are issued by the
+// realm to the signer of the token, for one of the roles that the Brickchain HASS Controller told us about. The result
+// tells which mandates are accepted, and why the token or each of its mandates is rejected.
+func (c *Controller) Verify(req *http.Request) *VerifyResult {
+	return c.verify(req, true)
+}
+
+// VerifyWithoutRecording is Verify for requests that don't reach Home Assistant, such as health checks. Tokens that
+// have already been used are still rejected, but the token isn't remembered, so that it can still be used once.
+func (c *Controller) VerifyWithoutRecording(req *http.Request) *VerifyResult {
+	return c.verify(req, false)
+}
+
+func (c *Controller) verify(req *http.Request, record bool) *VerifyResult {
+	result := &VerifyResult{
+		Mandates: make([]httphandler.AuthenticatedMandate, 0),
+	}
+
+	signer, token, hash, err := c.parseMandateToken(req)
+	if err != nil {
+		logger.Error(err)
+		result.Reason, result.Err = rejectedReason(err, ReasonInvalidToken), err
+		c.verified(result.Reason)
+		return result
+	}
+
+	result.Signer = signer
+	result.URI = token.URI
+	result.Expires = token.Timestamp.Add(time.Second * time.Duration(token.TTL))
+
+	c.lock.RLock()
+	realmKey, roles := c.realmKey, c.roles
+	c.lock.RUnlock()
+
+	if realmKey == nil {
+		logger.Warn("Not registered to the controller yet, can't verify mandates")
+		result.Reason, result.Err = ReasonNotRegistered, errors.New("Not registered to the controller yet")
+		c.verified(result.Reason)
+		return result
+	}
+
+	result.Results = make([]MandateResult, 0, len(token.Mandates))
+	for _, mandateString := range token.Mandates {
+		mandate, err := c.parseMandate(mandateString)
+		if err == nil {
+			err = matchMandate(mandate, signer, realmKey, roles)
+		}
+
+		m := MandateResult{
+			Reason: ReasonOK,
+		}
+		if mandate.Mandate != nil {
+			m.Role, m.RoleName = mandate.Mandate.Role, mandate.Mandate.RoleName
+		}
+		if err != nil {
+			logger.Debug(err)
+			m.Reason, m.Err = rejectedReason(err, ReasonInvalidMandate), err
+		} else {
+			result.Mandates = append(result.Mandates, mandate)
+		}
+
+		result.Results = append(result.Results, m)
+	}
+
+	// only remember tokens with an accepted mandate, so that anyone can't push the real ones out of the cache with
+	// tokens of their own
+	if result.OK() && c.replayed(hash, result.Expires.Add(c.skew()), record) {
+		logger.Error("Token has already been used")
+		result.Reason, result.Err = ReasonReplayed, errors.New("Token has already been used")
+		result.Mandates = result.Mandates[:0]
+		c.verified(result.Reason)
+		return result
+	}
+
+	if result.OK() {
+		result.Reason = ReasonOK
+	} else {
+		result.Reason = ReasonNoMatchingMandate
+	}
+	c.verified(result.Reason)
+
+	return result
+}
+
+// replayed checks the hash of a token against the replay cache, and remembers it there if record is set
+func (c *Controller) replayed(hash string, expires time.Time, record bool) bool {
+	replay := c.replay
+	if replay == nil {
+		return false
+	}
+
+	if !record {
+		return replay.used(hash)
+	}
+
+	return replay.check(hash, expires)
+}
+
+// VerifyMandates returns the accepted mandates in the mandate-token of an http request, see Verify
+func (c *Controller) VerifyMandates(req *http.Request) []httphandler.AuthenticatedMandate {
+	return c.Verify(req).Mandates
+}
+
+// matchMandate checks that a mandate is issued by the realm to the signer of the token, for one of the roles that the
+// controller told us about
+func matchMandate(mandate httphandler.AuthenticatedMandate, signer, realmKey *jose.JsonWebKey, roles []string) error {
+	if crypto.Thumbprint(mandate.Signer) != crypto.Thumbprint(realmKey) {
+		return rejected(ReasonWrongRealm, errors.New("Mandate is not issued by the realm"))
+	}
+
+	if crypto.Thumbprint(signer) != crypto.Thumbprint(mandate.Mandate.Recipient) {
+		return rejected(ReasonWrongRecipient, errors.New("Mandate is not issued to the signer of the token"))
+	}
+
+	for _, role := range roles {
+		if role == mandate.Mandate.Role {
+			return nil
+		}
+	}
+
+	return rejected(ReasonUnknownRole, errors.Errorf("Role %s is not one of the roles from the controller", mandate.Mandate.Role))
+}
+
+// rejectedError is returned when a mandate token or mandate is rejected, with the reason it was rejected for
+type rejectedError struct {
+	reason Reason
+	error
+}
+
+func rejected(reason Reason, err error) error {
+	return rejectedError{reason: reason, error: err}
+}
+
+// rejectedReason returns the reason of a rejectedError, or fallback for errors without one, which are broken tokens
+// or mandates
+func rejectedReason(err error, fallback Reason) Reason {
+	if r, ok := err.(rejectedError); ok {
+		return r.reason
+	}
+
+	return fallback
+}
@@ -0,0 +1,219 @@
+package hass
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// refresh the access token a bit before it expires
+const tokenExpiryMargin = time.Minute
+
+// Auth logs in to Home Assistant with a username and password and keeps a valid access token. Without a username the
+// legacy API password auth provider is used.
+type Auth struct {
+	client       *Client
+	username     string
+	password     string
+	lock         *sync.Mutex
+	clientID     string
+	accessToken  string
+	refreshToken string
+	expires      time.Time
+}
+
+// NewAuth returns a new instance of Auth
+func NewAuth(client *Client, username, password string) *Auth {
+	return &Auth{
+		client:   client,
+		username: username,
+		password: password,
+		lock:     &sync.Mutex{},
+	}
+}
+
+// NewRefreshAuth returns a new instance of Auth that gets access tokens with a refresh token that was handed out to
+// clientID, instead of logging in with a password
+func NewRefreshAuth(client *Client, clientID, refreshToken string) *Auth {
+	return &Auth{
+		client:       client,
+		lock:         &sync.Mutex{},
+		clientID:     clientID,
+		refreshToken: refreshToken,
+	}
+}
+
+// RefreshToken returns the refresh token we got when we logged in, which stays valid until it is revoked in Home
+// Assistant
+func (a *Auth) RefreshToken() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.refreshToken
+}
+
+// ClientID returns the client that the refresh token was handed out to
+func (a *Auth) ClientID() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.clientID
+}
+
+// SetRefreshToken sets a refresh token that was handed out to clientID before, like one kept from an earlier run, which
+// is used instead of logging in with the password for as long as it is valid
+func (a *Auth) SetRefreshToken(clientID, refreshToken string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.clientID = clientID
+	a.refreshToken = refreshToken
+	a.accessToken = ""
+}
+
+type loginFlowResponse struct {
+	Type   string            `json:"type"`
+	FlowID string            `json:"flow_id"`
+	Result string            `json:"result"`
+	Errors map[string]string `json:"errors"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Token returns a valid access token, logging in as clientID, which has to be the URL Home Assistant is reached at. The
+// token is refreshed when it is about to expire, and we log in again if that fails. Every login leaves a refresh token
+// behind in Home Assistant, so once we have one it is used for as long as it is valid, for the client it was handed out
+// to, also when another clientID is asked for.
+func (a *Auth) Token(clientID string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.accessToken != "" && time.Now().Add(tokenExpiryMargin).Before(a.expires) {
+		return a.accessToken, nil
+	}
+
+	if a.refreshToken != "" {
+		err := a.token(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {a.refreshToken},
+			"client_id":     {a.clientID},
+		})
+		if err == nil {
+			return a.accessToken, nil
+		}
+
+		// without a password there is no way to log in again
+		if a.password == "" {
+			return "", errors.Wrap(err, "failed to refresh access token")
+		}
+
+		a.refreshToken = ""
+	}
+
+	code, err := a.login(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.token(url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+		"client_id":  {clientID},
+	}); err != nil {
+		return "", err
+	}
+
+	a.clientID = clientID
+
+	return a.accessToken, nil
+}
+
+// login runs the Home Assistant login flow and returns the authorization code
+func (a *Auth) login(clientID string) (string, error) {
+	handler := []interface{}{"homeassistant", nil}
+	credentials := map[string]string{
+		"username":  a.username,
+		"password":  a.password,
+		"client_id": clientID,
+	}
+	if a.username == "" {
+		handler = []interface{}{"legacy_api_password", nil}
+		delete(credentials, "username")
+	}
+
+	flow := loginFlowResponse{}
+	if err := a.post("/auth/login_flow", map[string]interface{}{
+		"client_id":    clientID,
+		"handler":      handler,
+		"redirect_uri": strings.TrimSuffix(clientID, "/") + "/",
+	}, &flow); err != nil {
+		return "", errors.Wrap(err, "failed to start login flow")
+	}
+
+	result := loginFlowResponse{}
+	if err := a.post("/auth/login_flow/"+flow.FlowID, credentials, &result); err != nil {
+		return "", errors.Wrap(err, "failed to log in")
+	}
+
+	if result.Type != "create_entry" || result.Result == "" {
+		return "", errors.Errorf("failed to log in to Home Assistant: %v", result.Errors)
+	}
+
+	return result.Result, nil
+}
+
+func (a *Auth) post(path string, v interface{}, out interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.client.Do(http.MethodPost, path, bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (a *Auth) token(form url.Values) error {
+	res, err := a.client.send(http.MethodPost, "/auth/token", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "failed to get access token")
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read token response")
+	}
+
+	token := tokenResponse{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return errors.Wrap(err, "failed to unmarshal token response")
+	}
+
+	if token.AccessToken == "" {
+		return errors.New("no access token in token response")
+	}
+
+	a.accessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		a.refreshToken = token.RefreshToken
+	}
+	a.expires = time.Now().Add(time.Second * time.Duration(token.ExpiresIn))
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package hass
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authServer answers the login flow and token requests like Home Assistant, counting the logins and refreshes
+type authServer struct {
+	logins, refreshes int
+	clientIDs         []string
+	expiresIn         int
+}
+
+func (s *authServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/auth/login_flow":
+		fmt.Fprint(w, `{"type":"form","flow_id":"flow"}`)
+	case "/auth/login_flow/flow":
+		fmt.Fprint(w, `{"type":"create_entry","result":"code"}`)
+	case "/auth/token":
+		r.ParseForm()
+		s.clientIDs = append(s.clientIDs, r.PostForm.Get("client_id"))
+
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			s.logins++
+			fmt.Fprintf(w, `{"access_token":"access%d","refresh_token":"refresh%d","expires_in":%d}`, s.logins, s.logins, s.expiresIn)
+		case "refresh_token":
+			if r.PostForm.Get("refresh_token") != fmt.Sprintf("refresh%d", s.logins) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+
+			s.refreshes++
+			fmt.Fprintf(w, `{"access_token":"refreshed%d","expires_in":%d}`, s.refreshes, s.expiresIn)
+		}
+	}
+}
+
+func TestAuthReusesRefreshToken(t *testing.T) {
+	// tokens that expire right away, so that every call needs a new one
+	s := &authServer{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	a := NewAuth(NewClient(srv.URL, "", ""), "bob", "pw")
+
+	for i, clientID := range []string{"https://one.example/", "https://one.example/", "https://two.example/"} {
+		if _, err := a.Token(clientID); err != nil {
+			t.Fatalf("token %d: %s", i+1, err)
+		}
+	}
+
+	if s.logins != 1 || s.refreshes != 2 {
+		t.Errorf("%d logins and %d refreshes, want 1 and 2", s.logins, s.refreshes)
+	}
+
+	for _, clientID := range s.clientIDs {
+		if clientID != "https://one.example/" {
+			t.Errorf("token requested for %s, want the client the refresh token was handed out to", clientID)
+		}
+	}
+}
+
+func TestAuthSetRefreshToken(t *testing.T) {
+	s := &authServer{logins: 1, expiresIn: 1800}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	a := NewAuth(NewClient(srv.URL, "", ""), "bob", "pw")
+	a.SetRefreshToken("https://one.example/", "refresh1")
+
+	if token, err := a.Token("https://two.example/"); err != nil || token != "refreshed1" {
+		t.Fatalf("Token = %s, %v, want the token from the refresh token that was set", token, err)
+	}
+
+	// a refresh token that is no longer accepted is replaced by logging in again
+	a.SetRefreshToken("https://one.example/", "revoked")
+	if token, err := a.Token("https://two.example/"); err != nil || token != "access2" {
+		t.Fatalf("Token = %s, %v, want the token from a new login", token, err)
+	}
+
+	if a.RefreshToken() != "refresh2" || a.ClientID() != "https://two.example/" {
+		t.Errorf("refresh token %s for %s after logging in again", a.RefreshToken(), a.ClientID())
+	}
+}
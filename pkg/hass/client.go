@@ -0,0 +1,161 @@
+package hass
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long the entities of an area are cached before we ask Home Assistant again
+const areaCacheTTL = time.Minute
+
+// Client talks to the Home Assistant REST API on behalf of the proxy itself
+type Client struct {
+	url       string
+	host      string
+	token     string
+	http      *http.Client
+	areaLock  *sync.Mutex
+	areaCache map[string]areaEntities
+}
+
+type areaEntities struct {
+	entities []string
+	fetched  time.Time
+}
+
+// NewClient returns a new instance of Client for the Home Assistant API at url. host is used as the Host header if set,
+// and token is the access token sent in the X-HA-ACCESS header.
+func NewClient(url, host, token string) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(url, "/"),
+		host:  host,
+		token: token,
+		http: &http.Client{
+			Timeout: time.Second * 15,
+		},
+		areaLock:  &sync.Mutex{},
+		areaCache: make(map[string]areaEntities),
+	}
+}
+
+// Do sends a JSON request to the Home Assistant API and returns the response if it was successful
+func (c *Client) Do(method, path string, body io.Reader) (*http.Response, error) {
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+
+	return c.send(method, path, contentType, body)
+}
+
+func (c *Client) send(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	if c.host != "" {
+		req.Host = c.host
+	}
+
+	if c.token != "" {
+		req.Header.Set("X-HA-ACCESS", c.token)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send request to Home Assistant")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("Home Assistant responded with %s", res.Status)
+	}
+
+	return res, nil
+}
+
+// AreaEntities returns the IDs of the entities in an area, using the area_entities template function
+func (c *Client) AreaEntities(area string) ([]string, error) {
+	c.areaLock.Lock()
+	cached, ok := c.areaCache[area]
+	c.areaLock.Unlock()
+
+	if ok && cached.fetched.Add(areaCacheTTL).After(time.Now()) {
+		return cached.entities, nil
+	}
+
+	areaJSON, _ := json.Marshal(area)
+	reqBytes, _ := json.Marshal(map[string]string{
+		"template": fmt.Sprintf("{{ area_entities(%s) | join(',') }}", areaJSON),
+	})
+
+	res, err := c.Do(http.MethodPost, "/api/template", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	entities := make([]string, 0)
+	for _, id := range strings.Split(string(body), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			entities = append(entities, id)
+		}
+	}
+
+	c.areaLock.Lock()
+	c.areaCache[area] = areaEntities{
+		entities: entities,
+		fetched:  time.Now(),
+	}
+	c.areaLock.Unlock()
+
+	return entities, nil
+}
+
+// Ping checks that the Home Assistant API is running
+func (c *Client) Ping() error {
+	res, err := c.Do(http.MethodGet, "/api/", nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// Version returns the version of Home Assistant
+func (c *Client) Version() (string, error) {
+	res, err := c.Do(http.MethodGet, "/api/config", nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	config := struct {
+		Version string `json:"version"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
+		return "", errors.Wrap(err, "failed to parse config from Home Assistant")
+	}
+
+	return config.Version, nil
+}
@@ -0,0 +1,235 @@
+package hass
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EntityFunc decides if an entity can be accessed
+type EntityFunc func(entityID string) bool
+
+// REST endpoints that have an entity ID as the last part of the path
+var entityPaths = []string{
+	"/api/states/",
+	"/api/camera_proxy/",
+	"/api/camera_proxy_stream/",
+}
+
+// REST endpoints that don't tell anything about entities, and can be read with an entity scope
+var unscopedPaths = []string{
+	"/api",
+	"/api/config",
+	"/api/services",
+}
+
+// keys in service calls that target things other than entities, which we can't check against an entity scope
+var nonEntityTargets = []string{
+	"area_id",
+	"device_id",
+	"floor_id",
+	"label_id",
+}
+
+// EntityFromPath returns the entity ID of requests for a single entity, like /api/states/light.kitchen
+func EntityFromPath(path string) (string, bool) {
+	for _, prefix := range entityPaths {
+		if strings.HasPrefix(path, prefix) {
+			id := strings.TrimPrefix(path, prefix)
+			if id != "" && !strings.Contains(id, "/") {
+				return id, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// ScopeCheckable returns true for REST requests that can be limited to an entity scope: the state list, single entity
+// endpoints, service calls, and API endpoints that don't tell anything about entities. Other API endpoints, like
+// templates, events, history or the logbook, can read or change any entity. Requests outside of the API, like the
+// frontend, are not affected.
+func ScopeCheckable(method, path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	if path != "/api" && !strings.HasPrefix(path, "/api/") {
+		return true
+	}
+
+	if _, ok := EntityFromPath(path); ok {
+		return true
+	}
+
+	// WebSocket sessions are limited to the scope by WebSocketFilter
+	if path == "/api/websocket" {
+		return true
+	}
+
+	if _, _, ok := ServiceFromPath(path); ok && IsServiceCall(method, path) {
+		return true
+	}
+
+	if strings.ToUpper(method) != "GET" && strings.ToUpper(method) != "HEAD" {
+		return false
+	}
+
+	if IsStateList("GET", path) {
+		return true
+	}
+
+	for _, p := range unscopedPaths {
+		if path == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsServiceCall returns true for REST requests that call a service
+func IsServiceCall(method, path string) bool {
+	return strings.ToUpper(method) == "POST" && strings.HasPrefix(path, "/api/services/")
+}
+
+// ServiceFromPath returns the domain and service of REST service calls, like /api/services/light/turn_on
+func ServiceFromPath(path string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/services/"), "/")
+	if !strings.HasPrefix(path, "/api/services/") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// IsStateList returns true for REST requests that list the state of all entities
+func IsStateList(method, path string) bool {
+	return strings.ToUpper(method) == "GET" && strings.TrimSuffix(path, "/") == "/api/states"
+}
+
+type entityState struct {
+	EntityID string `json:"entity_id"`
+}
+
+// FilterStates removes the states of entities that can't be accessed from a JSON list of states
+func FilterStates(body []byte, allowed EntityFunc) ([]byte, error) {
+	states := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(body, &states); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal states")
+	}
+
+	filtered, err := filterStates(states, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(filtered)
+}
+
+func filterStates(states []json.RawMessage, allowed EntityFunc) ([]json.RawMessage, error) {
+	filtered := make([]json.RawMessage, 0, len(states))
+	for _, raw := range states {
+		state := entityState{}
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal state")
+		}
+
+		if allowed(state.EntityID) {
+			filtered = append(filtered, raw)
+		}
+	}
+
+	return filtered, nil
+}
+
+// ServiceCallAllowed checks that a service call only targets entities that can be accessed. Calls that target areas,
+// devices or all entities, or that don't target any entity at all, are not allowed since we can't tell what they affect.
+func ServiceCallAllowed(data map[string]interface{}, allowed EntityFunc) bool {
+	entities := make([]string, 0)
+
+	for _, key := range nonEntityTargets {
+		if _, ok := data[key]; ok {
+			return false
+		}
+	}
+
+	switch v := data["entity_id"].(type) {
+	case string:
+		for _, id := range strings.Split(v, ",") {
+			entities = append(entities, strings.TrimSpace(id))
+		}
+	case []interface{}:
+		for _, id := range v {
+			s, ok := id.(string)
+			if !ok {
+				return false
+			}
+			entities = append(entities, s)
+		}
+	default:
+		return false
+	}
+
+	if len(entities) < 1 {
+		return false
+	}
+
+	for _, id := range entities {
+		if id == "all" || !allowed(id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ServiceBodyAllowed checks the JSON body of a REST service call with ServiceCallAllowed
+func ServiceBodyAllowed(body []byte, allowed EntityFunc) bool {
+	data := make(map[string]interface{})
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &data); err != nil {
+			return false
+		}
+	}
+
+	return ServiceCallAllowed(data, allowed)
+}
+
+// ServiceBodyEntities returns the entity IDs that the JSON body of a REST service call targets
+func ServiceBodyEntities(body []byte) []string {
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil
+	}
+
+	return serviceEntities(data)
+}
+
+// CommandEntities returns the entity IDs that a websocket call_service command targets
+func CommandEntities(cmd Command) []string {
+	return serviceEntities(mergeTargets(cmd.ServiceData, cmd.Target))
+}
+
+func serviceEntities(data map[string]interface{}) []string {
+	ids := make([]string, 0)
+	switch v := data["entity_id"].(type) {
+	case string:
+		ids = append(ids, v)
+	case []interface{}:
+		for _, id := range v {
+			if s, ok := id.(string); ok {
+				ids = append(ids, s)
+			}
+		}
+	}
+
+	entities := make([]string, 0, len(ids))
+	for _, s := range ids {
+		for _, id := range strings.Split(s, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				entities = append(entities, id)
+			}
+		}
+	}
+
+	return entities
+}
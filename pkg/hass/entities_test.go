@@ -0,0 +1,152 @@
+package hass
+
+import (
+	"strings"
+	"testing"
+)
+
+// lightsOnly allows the lights and nothing else
+func lightsOnly(entityID string) bool {
+	return strings.HasPrefix(entityID, "light.")
+}
+
+func TestEntityFromPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		entity string
+		ok     bool
+	}{
+		{"/api/states/light.kitchen", "light.kitchen", true},
+		{"/api/camera_proxy/camera.door", "camera.door", true},
+		{"/api/camera_proxy_stream/camera.door", "camera.door", true},
+		{"/api/states/", "", false},
+		{"/api/states", "", false},
+		{"/api/states/light.kitchen/extra", "", false},
+		{"/api/history/period", "", false},
+	}
+
+	for _, test := range tests {
+		entity, ok := EntityFromPath(test.path)
+		if entity != test.entity || ok != test.ok {
+			t.Errorf("EntityFromPath(%s) = %q, %v, want %q, %v", test.path, entity, ok, test.entity, test.ok)
+		}
+	}
+}
+
+func TestScopeCheckable(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		checkable bool
+	}{
+		{"GET", "/", true},
+		{"GET", "/frontend_latest/app.js", true},
+		{"GET", "/api", true},
+		{"GET", "/api/", true},
+		{"GET", "/api/config", true},
+		{"GET", "/api/services", true},
+		{"POST", "/api/config", false},
+		{"GET", "/api/states", true},
+		{"HEAD", "/api/states", true},
+		{"GET", "/api/states/light.kitchen", true},
+		{"POST", "/api/states/light.kitchen", true},
+		{"GET", "/api/websocket", true},
+		{"POST", "/api/services/light/turn_on", true},
+		{"GET", "/api/services/light/turn_on", false},
+		{"POST", "/api/services/light", false},
+		{"GET", "/api/history/period", false},
+		{"GET", "/api/logbook", false},
+		{"GET", "/api/events", false},
+		{"POST", "/api/events/call_service", false},
+		{"POST", "/api/template", false},
+		{"GET", "/api/error_log", false},
+	}
+
+	for _, test := range tests {
+		if checkable := ScopeCheckable(test.method, test.path); checkable != test.checkable {
+			t.Errorf("ScopeCheckable(%s, %s) = %v, want %v", test.method, test.path, checkable, test.checkable)
+		}
+	}
+}
+
+func TestServiceFromPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		domain  string
+		service string
+		ok      bool
+	}{
+		{"/api/services/light/turn_on", "light", "turn_on", true},
+		{"/api/services/light", "", "", false},
+		{"/api/services/light/", "", "", false},
+		{"/api/services//turn_on", "", "", false},
+		{"/api/services/light/turn_on/extra", "", "", false},
+		{"/api/states/light.kitchen", "", "", false},
+	}
+
+	for _, test := range tests {
+		domain, service, ok := ServiceFromPath(test.path)
+		if domain != test.domain || service != test.service || ok != test.ok {
+			t.Errorf("ServiceFromPath(%s) = %q, %q, %v, want %q, %q, %v", test.path, domain, service, ok, test.domain, test.service, test.ok)
+		}
+	}
+}
+
+func TestServiceBodyAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		allowed bool
+	}{
+		{"entity in scope", `{"entity_id": "light.kitchen"}`, true},
+		{"entity out of scope", `{"entity_id": "lock.front_door"}`, false},
+		{"comma separated", `{"entity_id": "light.kitchen, light.hall"}`, true},
+		{"comma separated with one out of scope", `{"entity_id": "light.kitchen,lock.front_door"}`, false},
+		{"list", `{"entity_id": ["light.kitchen", "light.hall"]}`, true},
+		{"list with one out of scope", `{"entity_id": ["light.kitchen", "lock.front_door"]}`, false},
+		{"list with a number", `{"entity_id": ["light.kitchen", 1]}`, false},
+		{"empty list", `{"entity_id": []}`, false},
+		{"all", `{"entity_id": "all"}`, false},
+		{"no entity", `{"brightness": 100}`, false},
+		{"empty body", ``, false},
+		{"not json", `entity_id=light.kitchen`, false},
+		{"area", `{"area_id": "kitchen"}`, false},
+		{"device next to entity", `{"entity_id": "light.kitchen", "device_id": "abc"}`, false},
+		{"floor next to entity", `{"entity_id": "light.kitchen", "floor_id": "ground"}`, false},
+		{"label next to entity", `{"entity_id": "light.kitchen", "label_id": "lamps"}`, false},
+	}
+
+	for _, test := range tests {
+		if allowed := ServiceBodyAllowed([]byte(test.body), lightsOnly); allowed != test.allowed {
+			t.Errorf("%s: ServiceBodyAllowed(%s) = %v, want %v", test.name, test.body, allowed, test.allowed)
+		}
+	}
+}
+
+func TestFilterStates(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		filtered string
+		err      bool
+	}{
+		{"filters", `[{"entity_id":"light.kitchen","state":"on"},{"entity_id":"lock.front_door","state":"locked"}]`, `[{"entity_id":"light.kitchen","state":"on"}]`, false},
+		{"nothing left", `[{"entity_id":"lock.front_door"}]`, `[]`, false},
+		{"empty", `[]`, `[]`, false},
+		{"no entity id", `[{"state":"on"}]`, `[]`, false},
+		{"not a list", `{"entity_id":"light.kitchen"}`, ``, true},
+		{"broken state", `[1]`, ``, true},
+	}
+
+	for _, test := range tests {
+		filtered, err := FilterStates([]byte(test.body), lightsOnly)
+		if (err != nil) != test.err {
+			t.Errorf("%s: FilterStates returned error %v", test.name, err)
+			continue
+		}
+
+		if string(filtered) != test.filtered {
+			t.Errorf("%s: FilterStates = %s, want %s", test.name, filtered, test.filtered)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package hass
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// websocket commands that only concern the session itself, and are always allowed
+var sessionCommands = map[string]bool{
+	"auth":               true,
+	"ping":               true,
+	"supported_features": true,
+	"unsubscribe_events": true,
+}
+
+// websocket commands that can be used with an entity scope, either because the filter limits them to the entities in
+// scope, or because they don't tell anything about entities. Everything else is rejected.
+var scopedCommands = map[string]bool{
+	"get_config":         true,
+	"get_services":       true,
+	"get_states":         true,
+	"subscribe_events":   true,
+	"subscribe_entities": true,
+	"call_service":       true,
+}
+
+// the REST requests that websocket commands are checked against the method and path rules as, for the commands that
+// have one
+var commandPaths = map[string]struct{ method, path string }{
+	"get_config":         {"GET", "/api/config"},
+	"get_services":       {"GET", "/api/services"},
+	"get_states":         {"GET", "/api/states"},
+	"subscribe_entities": {"GET", "/api/states"},
+	"subscribe_events":   {"GET", "/api/stream"},
+	"render_template":    {"POST", "/api/template"},
+}
+
+// Command is a command sent by the client on a Home Assistant websocket session, with the fields that are used to
+// decide if it is allowed
+type Command struct {
+	ID        int64
+	Type      string
+	Domain    string
+	Service   string
+	EventType string
+	// ServiceData and Target hold the entities that call_service targets
+	ServiceData map[string]interface{}
+	Target      map[string]interface{}
+	// Subscription is the ID of the subscribe command that unsubscribe_events ends
+	Subscription int64
+}
+
+// CommandFunc decides if a websocket command is allowed. It returns the entities that the results and events of the
+// command are limited to, or nil if they aren't limited.
+type CommandFunc func(cmd Command) (EntityFunc, bool)
+
+// WebSocketFilter limits what a Home Assistant websocket session can do. Every command the client sends is checked with
+// a CommandFunc, and the get_states, subscribe_events and subscribe_entities commands are kept track of so that their
+// results and events can be limited to the entities that the command was allowed for. Messages it can't parse are
+// rejected.
+type WebSocketFilter struct {
+	authorize CommandFunc
+	lock      *sync.Mutex
+	commands  map[int64]wsSubscription
+}
+
+// wsSubscription is a command whose results or events are filtered
+type wsSubscription struct {
+	command string
+	allowed EntityFunc
+}
+
+// NewWebSocketFilter returns a new instance of WebSocketFilter
+func NewWebSocketFilter(authorize CommandFunc) *WebSocketFilter {
+	return &WebSocketFilter{
+		authorize: authorize,
+		lock:      &sync.Mutex{},
+		commands:  make(map[int64]wsSubscription),
+	}
+}
+
+// CommandInScope checks that a command can be limited to the allowed entities: it has to be one of the commands that
+// the filter knows how to limit, and a call_service has to target only allowed entities
+func CommandInScope(cmd Command, allowed EntityFunc) bool {
+	if sessionCommands[cmd.Type] {
+		return true
+	}
+
+	if !scopedCommands[cmd.Type] {
+		return false
+	}
+
+	if cmd.Type == "call_service" {
+		return ServiceCallAllowed(mergeTargets(cmd.ServiceData, cmd.Target), allowed)
+	}
+
+	return true
+}
+
+// CommandRequest returns the REST request that a websocket command does the same as, like POST
+// /api/services/<domain>/<service> for call_service, so that it can be checked against the method and path rules.
+// It returns false for commands that don't have one.
+func CommandRequest(cmd Command) (string, string, bool) {
+	switch cmd.Type {
+	case "call_service":
+		if !pathPart(cmd.Domain) || !pathPart(cmd.Service) {
+			return "", "", false
+		}
+
+		return "POST", "/api/services/" + cmd.Domain + "/" + cmd.Service, true
+
+	case "fire_event":
+		if !pathPart(cmd.EventType) {
+			return "", "", false
+		}
+
+		return "POST", "/api/events/" + cmd.EventType, true
+	}
+
+	req, ok := commandPaths[cmd.Type]
+	return req.method, req.path, ok
+}
+
+// pathPart checks that a value from a command can be used as a single part of a path
+func pathPart(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/?#")
+}
+
+// ParseCommand reads the fields of a command that are used to decide if it is allowed. Decoding into a struct would also match keys
+// in another case, like "Type", and Home Assistant only reads the exact keys, so the message is read as a map and
+// only the exact keys are used.
+func ParseCommand(msg []byte) (Command, error) {
+	cmd := Command{}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return cmd, err
+	}
+
+	for key, v := range map[string]interface{}{
+		"id":           &cmd.ID,
+		"type":         &cmd.Type,
+		"domain":       &cmd.Domain,
+		"service":      &cmd.Service,
+		"event_type":   &cmd.EventType,
+		"service_data": &cmd.ServiceData,
+		"target":       &cmd.Target,
+		"subscription": &cmd.Subscription,
+	} {
+		raw, ok := fields[key]
+		if !ok {
+			continue
+		}
+
+		if err := json.Unmarshal(raw, v); err != nil {
+			return cmd, err
+		}
+	}
+
+	return cmd, nil
+}
+
+type wsResult struct {
+	ID      int64         `json:"id"`
+	Type    string        `json:"type"`
+	Success bool          `json:"success"`
+	Error   wsResultError `json:"error"`
+}
+
+type wsResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FromClient inspects a message sent by the client. It returns the message to pass on to Home Assistant, or nil and
+// a reply to send back to the client if the command is not allowed.
+func (f *WebSocketFilter) FromClient(msg []byte) ([]byte, []byte) {
+	cmd, err := ParseCommand(msg)
+	if err != nil {
+		// not a single command we understand, so we can't tell what it would do
+		return nil, unauthorized(0, "Message is not a command that can be checked against the mandates")
+	}
+
+	if cmd.Type == "unsubscribe_events" {
+		f.lock.Lock()
+		delete(f.commands, cmd.Subscription)
+		f.lock.Unlock()
+	}
+
+	if sessionCommands[cmd.Type] {
+		return msg, nil
+	}
+
+	allowed, ok := f.authorize(cmd)
+	if !ok {
+		return nil, unauthorized(cmd.ID, "Command is not allowed by the mandates")
+	}
+
+	switch cmd.Type {
+	case "get_states", "subscribe_events", "subscribe_entities":
+		f.lock.Lock()
+		if allowed != nil {
+			f.commands[cmd.ID] = wsSubscription{command: cmd.Type, allowed: allowed}
+		} else {
+			delete(f.commands, cmd.ID)
+		}
+		f.lock.Unlock()
+	}
+
+	return msg, nil
+}
+
+// FromServer filters a message sent by Home Assistant. It returns nil if nothing in the message can be passed on.
+func (f *WebSocketFilter) FromServer(msg []byte) []byte {
+	// Home Assistant can coalesce several messages into a list
+	list := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(msg, &list); err == nil {
+		filtered := make([]json.RawMessage, 0, len(list))
+		for _, m := range list {
+			if out := f.filterServerMessage(m); out != nil {
+				filtered = append(filtered, out)
+			}
+		}
+
+		if len(filtered) < 1 {
+			return nil
+		}
+
+		b, _ := json.Marshal(filtered)
+		return b
+	}
+
+	return f.filterServerMessage(msg)
+}
+
+func (f *WebSocketFilter) filterServerMessage(msg []byte) []byte {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil
+	}
+
+	var id int64
+	if err := json.Unmarshal(fields["id"], &id); err != nil {
+		return msg
+	}
+
+	var typ string
+	_ = json.Unmarshal(fields["type"], &typ)
+
+	f.lock.Lock()
+	sub := f.commands[id]
+	if sub.command == "get_states" && typ == "result" {
+		delete(f.commands, id)
+	}
+	f.lock.Unlock()
+
+	command := sub.command
+
+	switch {
+	case command == "get_states" && typ == "result":
+		states := make([]json.RawMessage, 0)
+		if err := json.Unmarshal(fields["result"], &states); err != nil {
+			return nil
+		}
+
+		filtered, err := filterStates(states, sub.allowed)
+		if err != nil {
+			return nil
+		}
+
+		fields["result"], _ = json.Marshal(filtered)
+
+	case command == "subscribe_events" && typ == "event":
+		event := struct {
+			Data struct {
+				EntityID string `json:"entity_id"`
+			} `json:"data"`
+		}{}
+		if err := json.Unmarshal(fields["event"], &event); err != nil {
+			return nil
+		}
+
+		// events that aren't about a single entity, like service calls, can't be checked against the scope
+		if event.Data.EntityID == "" || !sub.allowed(event.Data.EntityID) {
+			return nil
+		}
+
+		return msg
+
+	case command == "subscribe_entities" && typ == "event":
+		event := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(fields["event"], &event); err != nil {
+			return nil
+		}
+
+		if !filterEntityEvent(event, sub.allowed) {
+			return nil
+		}
+
+		fields["event"], _ = json.Marshal(event)
+
+	default:
+		return msg
+	}
+
+	b, _ := json.Marshal(fields)
+	return b
+}
+
+// filterEntityEvent removes entities from the added (a), changed (c) and removed (r) parts of a subscribe_entities
+// event, and returns false if nothing is left
+func filterEntityEvent(event map[string]json.RawMessage, allowed EntityFunc) bool {
+	left := false
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := event[key]; !ok {
+			continue
+		}
+
+		entities := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(event[key], &entities); err != nil {
+			delete(event, key)
+			continue
+		}
+
+		for id := range entities {
+			if !allowed(id) {
+				delete(entities, id)
+			}
+		}
+
+		if len(entities) > 0 {
+			left = true
+		}
+		event[key], _ = json.Marshal(entities)
+	}
+
+	if _, ok := event["r"]; ok {
+		removed := make([]string, 0)
+		_ = json.Unmarshal(event["r"], &removed)
+
+		filtered := make([]string, 0, len(removed))
+		for _, id := range removed {
+			if allowed(id) {
+				filtered = append(filtered, id)
+			}
+		}
+
+		if len(filtered) > 0 {
+			left = true
+		}
+		event["r"], _ = json.Marshal(filtered)
+	}
+
+	return left
+}
+
+// mergeTargets combines the service data and target of a call_service command, collecting the entity IDs of both
+func mergeTargets(serviceData, target map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	entities := make([]interface{}, 0)
+
+	for _, m := range []map[string]interface{}{serviceData, target} {
+		for k, v := range m {
+			if k != "entity_id" {
+				merged[k] = v
+				continue
+			}
+
+			switch ids := v.(type) {
+			case []interface{}:
+				entities = append(entities, ids...)
+			default:
+				entities = append(entities, ids)
+			}
+		}
+	}
+
+	if len(entities) > 0 {
+		merged["entity_id"] = entities
+	}
+
+	return merged
+}
+
+func unauthorized(id int64, message string) []byte {
+	res := wsResult{
+		ID:   id,
+		Type: "result",
+		Error: wsResultError{
+			Code:    "unauthorized",
+			Message: message,
+		},
+	}
+
+	b, _ := json.Marshal(res)
+	return b
+}
+
+// SetAuthToken replaces the access token in the auth message that a client sends when the websocket opens. Other
+// messages are returned as they are.
+func SetAuthToken(msg []byte, token string) []byte {
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(msg, &data); err != nil || data["type"] != "auth" {
+		return msg
+	}
+
+	delete(data, "api_password")
+	data["access_token"] = token
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return msg
+	}
+
+	return b
+}
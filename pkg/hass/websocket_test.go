@@ -0,0 +1,233 @@
+package hass
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// inScope allows the commands that can be limited to the allowed entities, and limits them to those
+func inScope(allowed EntityFunc) CommandFunc {
+	return func(cmd Command) (EntityFunc, bool) {
+		return allowed, CommandInScope(cmd, allowed)
+	}
+}
+
+func TestWebSocketFilterFromClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		allowed bool
+	}{
+		{"auth", `{"type":"auth","access_token":"abc"}`, true},
+		{"ping", `{"id":1,"type":"ping"}`, true},
+		{"get_states", `{"id":1,"type":"get_states"}`, true},
+		{"subscribe_events", `{"id":1,"type":"subscribe_events","event_type":"state_changed"}`, true},
+		{"subscribe_entities", `{"id":1,"type":"subscribe_entities"}`, true},
+		{"unsubscribe_events", `{"id":2,"type":"unsubscribe_events","subscription":1}`, true},
+		{"call_service in scope", `{"id":1,"type":"call_service","domain":"light","service":"turn_on","service_data":{"entity_id":"light.kitchen"}}`, true},
+		{"call_service with target", `{"id":1,"type":"call_service","domain":"light","service":"turn_on","target":{"entity_id":["light.kitchen","light.hall"]}}`, true},
+		{"call_service out of scope", `{"id":1,"type":"call_service","domain":"lock","service":"unlock","service_data":{"entity_id":"lock.front_door"}}`, false},
+		{"call_service target out of scope", `{"id":1,"type":"call_service","domain":"light","service":"turn_on","service_data":{"entity_id":"light.kitchen"},"target":{"entity_id":"lock.front_door"}}`, false},
+		{"call_service on an area", `{"id":1,"type":"call_service","domain":"light","service":"turn_on","target":{"area_id":"kitchen"}}`, false},
+		{"call_service on a device", `{"id":1,"type":"call_service","domain":"light","service":"turn_on","target":{"entity_id":"light.kitchen","device_id":"abc"}}`, false},
+		{"call_service without target", `{"id":1,"type":"call_service","domain":"homeassistant","service":"restart"}`, false},
+		{"call_service on all", `{"id":1,"type":"call_service","domain":"light","service":"turn_off","service_data":{"entity_id":"all"}}`, false},
+		{"unknown command", `{"id":1,"type":"render_template","template":"{{ states.lock.front_door.state }}"}`, false},
+		{"history", `{"id":1,"type":"history/stream","entity_ids":["lock.front_door"]}`, false},
+		{"fire_event", `{"id":1,"type":"fire_event","event_type":"call_service"}`, false},
+		{"type in another case", `{"id":1,"type":"render_template","Type":"ping","template":"{{ states.lock.front_door.state }}"}`, false},
+		{"service data in another case", `{"id":1,"type":"call_service","domain":"lock","service":"unlock","service_data":{"entity_id":"lock.front_door"},"SERVICE_DATA":{"entity_id":"light.x"}}`, false},
+		{"target in another case", `{"id":1,"type":"call_service","domain":"lock","service":"unlock","target":{"entity_id":"lock.front_door"},"Target":{"entity_id":"light.x"}}`, false},
+		{"entity id in another case", `{"id":1,"type":"call_service","domain":"lock","service":"unlock","service_data":{"entity_id":"lock.front_door","Entity_ID":"light.x"}}`, false},
+		{"list of commands", `[{"id":1,"type":"ping"}]`, false},
+		{"not json", `ping`, false},
+	}
+
+	for _, test := range tests {
+		f := NewWebSocketFilter(inScope(lightsOnly))
+		out, reply := f.FromClient([]byte(test.msg))
+
+		if test.allowed {
+			if string(out) != test.msg || reply != nil {
+				t.Errorf("%s: should be passed on, got %s and reply %s", test.name, out, reply)
+			}
+			continue
+		}
+
+		if out != nil {
+			t.Errorf("%s: should not be passed on, got %s", test.name, out)
+		}
+
+		res := wsResult{}
+		if err := json.Unmarshal(reply, &res); err != nil || res.Type != "result" || res.Success || res.Error.Code != "unauthorized" {
+			t.Errorf("%s: should be answered with an unauthorized result, got %s", test.name, reply)
+		}
+	}
+}
+
+func TestWebSocketFilterFromServer(t *testing.T) {
+	// the commands the client has sent, before the messages from the server in each test
+	commands := []string{
+		`{"id":1,"type":"get_states"}`,
+		`{"id":2,"type":"subscribe_events","event_type":"state_changed"}`,
+		`{"id":3,"type":"subscribe_entities"}`,
+		`{"id":4,"type":"get_config"}`,
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+		out  string
+	}{
+		{"get_states result", `{"id":1,"type":"result","success":true,"result":[{"entity_id":"light.kitchen"},{"entity_id":"lock.front_door"}]}`, `{"id":1,"result":[{"entity_id":"light.kitchen"}],"success":true,"type":"result"}`},
+		{"broken get_states result", `{"id":1,"type":"result","success":true,"result":{"entity_id":"lock.front_door"}}`, ``},
+		{"event in scope", `{"id":2,"type":"event","event":{"event_type":"state_changed","data":{"entity_id":"light.kitchen"}}}`, `{"id":2,"type":"event","event":{"event_type":"state_changed","data":{"entity_id":"light.kitchen"}}}`},
+		{"event out of scope", `{"id":2,"type":"event","event":{"event_type":"state_changed","data":{"entity_id":"lock.front_door"}}}`, ``},
+		{"event without entity", `{"id":2,"type":"event","event":{"event_type":"call_service","data":{"domain":"lock","service":"unlock"}}}`, ``},
+		{"entities event", `{"id":3,"type":"event","event":{"a":{"light.kitchen":{"s":"on"},"lock.front_door":{"s":"locked"}},"r":["light.hall","lock.back_door"]}}`, `{"event":{"a":{"light.kitchen":{"s":"on"}},"r":["light.hall"]},"id":3,"type":"event"}`},
+		{"entities event out of scope", `{"id":3,"type":"event","event":{"c":{"lock.front_door":{"+":{"s":"unlocked"}}}}}`, ``},
+		{"other result", `{"id":4,"type":"result","success":true,"result":{"version":"2024.1.0"}}`, `{"id":4,"type":"result","success":true,"result":{"version":"2024.1.0"}}`},
+		{"auth_ok", `{"type":"auth_ok","ha_version":"2024.1.0"}`, `{"type":"auth_ok","ha_version":"2024.1.0"}`},
+		{"not json", `pong`, ``},
+		{"coalesced", `[{"id":2,"type":"event","event":{"data":{"entity_id":"light.kitchen"}}},{"id":2,"type":"event","event":{"data":{"entity_id":"lock.front_door"}}},{"id":4,"type":"result","success":true}]`, `[{"id":2,"type":"event","event":{"data":{"entity_id":"light.kitchen"}}},{"id":4,"type":"result","success":true}]`},
+		{"coalesced out of scope", `[{"id":2,"type":"event","event":{"data":{"entity_id":"lock.front_door"}}},{"id":3,"type":"event","event":{"a":{"lock.back_door":{}}}}]`, ``},
+	}
+
+	for _, test := range tests {
+		f := NewWebSocketFilter(inScope(lightsOnly))
+		for _, cmd := range commands {
+			if out, _ := f.FromClient([]byte(cmd)); out == nil {
+				t.Fatalf("%s: command %s was rejected", test.name, cmd)
+			}
+		}
+
+		if out := f.FromServer([]byte(test.msg)); string(out) != test.out {
+			t.Errorf("%s: FromServer = %s, want %s", test.name, out, test.out)
+		}
+	}
+}
+
+func TestWebSocketFilterUnsubscribe(t *testing.T) {
+	f := NewWebSocketFilter(inScope(lightsOnly))
+	f.FromClient([]byte(`{"id":1,"type":"subscribe_events"}`))
+	f.FromClient([]byte(`{"id":2,"type":"unsubscribe_events","subscription":1}`))
+
+	// a message for the ended subscription is no longer known as an event to filter, and the get_states result for
+	// a reused ID isn't either
+	if out := f.FromServer([]byte(`{"id":1,"type":"event","event":{"data":{"entity_id":"lock.front_door"}}}`)); out == nil {
+		t.Error("message for an ended subscription should not be filtered as an event of it")
+	}
+
+	f.FromClient([]byte(`{"id":3,"type":"get_states"}`))
+	f.FromServer([]byte(`{"id":3,"type":"result","success":true,"result":[]}`))
+	out := f.FromServer([]byte(`{"id":3,"type":"result","success":true,"result":[{"entity_id":"lock.front_door"}]}`))
+	if out == nil {
+		t.Error("get_states should only be filtered once")
+	}
+}
+
+func TestWebSocketFilterIDInAnotherCase(t *testing.T) {
+	f := NewWebSocketFilter(inScope(lightsOnly))
+	if out, _ := f.FromClient([]byte(`{"id":5,"Id":6,"type":"subscribe_events"}`)); out == nil {
+		t.Fatal("subscribe_events should be passed on")
+	}
+
+	// Home Assistant sends the events for the subscription with the id it read, which is the lowercase one
+	if out := f.FromServer([]byte(`{"id":5,"type":"event","event":{"data":{"entity_id":"lock.front_door"}}}`)); out != nil {
+		t.Errorf("event out of scope should be dropped, got %s", out)
+	}
+}
+
+func TestWebSocketFilterCommandScope(t *testing.T) {
+	// get_states is allowed without limits, and the events only for the lights
+	f := NewWebSocketFilter(func(cmd Command) (EntityFunc, bool) {
+		if cmd.Type == "get_states" {
+			return nil, true
+		}
+
+		return lightsOnly, cmd.Type == "subscribe_events"
+	})
+
+	if out, _ := f.FromClient([]byte(`{"id":1,"type":"get_states"}`)); out == nil {
+		t.Fatal("get_states should be passed on")
+	}
+
+	if out, _ := f.FromClient([]byte(`{"id":2,"type":"subscribe_events"}`)); out == nil {
+		t.Fatal("subscribe_events should be passed on")
+	}
+
+	if out, reply := f.FromClient([]byte(`{"id":3,"type":"get_config"}`)); out != nil || reply == nil {
+		t.Errorf("get_config should be refused, got %s", out)
+	}
+
+	if out := f.FromServer([]byte(`{"id":1,"type":"result","success":true,"result":[{"entity_id":"lock.front_door"}]}`)); out == nil {
+		t.Error("result of an unlimited command should not be filtered")
+	}
+
+	if out := f.FromServer([]byte(`{"id":2,"type":"event","event":{"data":{"entity_id":"lock.front_door"}}}`)); out != nil {
+		t.Errorf("event out of scope should be dropped, got %s", out)
+	}
+}
+
+func TestCommandRequest(t *testing.T) {
+	tests := []struct {
+		msg    string
+		method string
+		path   string
+		ok     bool
+	}{
+		{`{"id":1,"type":"call_service","domain":"lock","service":"unlock"}`, "POST", "/api/services/lock/unlock", true},
+		{`{"id":1,"type":"call_service","domain":"lock"}`, "", "", false},
+		{`{"id":1,"type":"call_service","domain":"lock/unlock","service":"x"}`, "", "", false},
+		{`{"id":1,"type":"call_service","domain":"..","service":"config"}`, "", "", false},
+		{`{"id":1,"type":"call_service","domain":"lock","service":"unlock?x"}`, "", "", false},
+		{`{"id":1,"type":"fire_event","event_type":"doorbell"}`, "POST", "/api/events/doorbell", true},
+		{`{"id":1,"type":"fire_event"}`, "", "", false},
+		{`{"id":1,"type":"get_states"}`, "GET", "/api/states", true},
+		{`{"id":1,"type":"subscribe_entities"}`, "GET", "/api/states", true},
+		{`{"id":1,"type":"subscribe_events"}`, "GET", "/api/stream", true},
+		{`{"id":1,"type":"get_config"}`, "GET", "/api/config", true},
+		{`{"id":1,"type":"get_services"}`, "GET", "/api/services", true},
+		{`{"id":1,"type":"render_template","template":"{{ 1 }}"}`, "POST", "/api/template", true},
+		{`{"id":1,"type":"history/stream"}`, "", "", false},
+		{`{"id":1,"type":"call_service","Domain":"light","domain":"lock","service":"unlock"}`, "POST", "/api/services/lock/unlock", true},
+	}
+
+	for _, test := range tests {
+		cmd, err := ParseCommand([]byte(test.msg))
+		if err != nil {
+			t.Fatalf("ParseCommand(%s): %s", test.msg, err)
+		}
+
+		method, path, ok := CommandRequest(cmd)
+		if method != test.method || path != test.path || ok != test.ok {
+			t.Errorf("CommandRequest(%s) = %s %s %v, want %s %s %v", test.msg, method, path, ok, test.method, test.path, test.ok)
+		}
+	}
+}
+
+func TestCommandEntities(t *testing.T) {
+	tests := []struct {
+		msg      string
+		entities []string
+	}{
+		{`{"id":1,"type":"call_service","service_data":{"entity_id":"light.kitchen"}}`, []string{"light.kitchen"}},
+		{`{"id":1,"type":"call_service","service_data":{"entity_id":"light.kitchen, light.hall"}}`, []string{"light.kitchen", "light.hall"}},
+		{`{"id":1,"type":"call_service","target":{"entity_id":["light.kitchen","lock.front_door"]}}`, []string{"light.kitchen", "lock.front_door"}},
+		{`{"id":1,"type":"call_service","service_data":{"entity_id":"light.kitchen"},"target":{"entity_id":"lock.front_door"}}`, []string{"light.kitchen", "lock.front_door"}},
+		{`{"id":1,"type":"call_service","target":{"area_id":"kitchen"}}`, []string{}},
+		{`{"id":1,"type":"call_service","Target":{"entity_id":"lock.front_door"}}`, []string{}},
+	}
+
+	for _, test := range tests {
+		cmd, err := ParseCommand([]byte(test.msg))
+		if err != nil {
+			t.Fatalf("ParseCommand(%s): %s", test.msg, err)
+		}
+
+		if entities := CommandEntities(cmd); !reflect.DeepEqual(entities, test.entities) {
+			t.Errorf("CommandEntities(%s) = %v, want %v", test.msg, entities, test.entities)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package limit
+
+import "sync"
+
+// Concurrency caps the number of things, like requests or sessions, that are going on at the same time for every key
+type Concurrency struct {
+	lock   *sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+// NewConcurrency returns a new instance of Concurrency that allows max at the same time per key, or any number if
+// max is 0
+func NewConcurrency(max int) *Concurrency {
+	return &Concurrency{
+		lock:   &sync.Mutex{},
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// SetMax changes how many are allowed at the same time. Whatever is already going on is not affected.
+func (c *Concurrency) SetMax(max int) {
+	c.lock.Lock()
+	c.max = max
+	c.lock.Unlock()
+}
+
+// Acquire starts something for key and returns true, or returns false if the cap has been reached. Every successful
+// Acquire has to be followed by a Release.
+func (c *Concurrency) Acquire(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.max > 0 && c.counts[key] >= c.max {
+		return false
+	}
+
+	c.counts[key]++
+
+	return true
+}
+
+// Release marks something started with Acquire as done
+func (c *Concurrency) Release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.counts[key]--
+	if c.counts[key] <= 0 {
+		delete(c.counts, key)
+	}
+}
@@ -0,0 +1,72 @@
+package limit
+
+import "testing"
+
+func TestConcurrency(t *testing.T) {
+	c := NewConcurrency(2)
+
+	tests := []struct {
+		name    string
+		acquire string
+		release string
+		ok      bool
+	}{
+		{"first", "alice", "", true},
+		{"second", "alice", "", true},
+		{"over the cap", "alice", "", false},
+		{"another key", "bob", "", true},
+		{"after a release", "alice", "alice", true},
+		{"over the cap again", "alice", "", false},
+	}
+
+	for _, test := range tests {
+		if test.release != "" {
+			c.Release(test.release)
+		}
+
+		if ok := c.Acquire(test.acquire); ok != test.ok {
+			t.Errorf("%s: Acquire(%s) = %v, want %v", test.name, test.acquire, ok, test.ok)
+		}
+	}
+}
+
+func TestConcurrencySetMax(t *testing.T) {
+	c := NewConcurrency(0)
+
+	for i := 0; i < 10; i++ {
+		if !c.Acquire("alice") {
+			t.Fatal("no cap refused an acquire")
+		}
+	}
+
+	// a lower cap leaves what is going on alone, but nothing new starts until enough is released
+	c.SetMax(5)
+	if c.Acquire("alice") {
+		t.Fatal("acquired over the new cap")
+	}
+
+	for i := 0; i < 6; i++ {
+		c.Release("alice")
+	}
+	if !c.Acquire("alice") {
+		t.Error("refused after releasing below the new cap")
+	}
+}
+
+func TestConcurrencyRelease(t *testing.T) {
+	c := NewConcurrency(1)
+
+	c.Acquire("alice")
+	c.Release("alice")
+	c.Release("alice")
+
+	if len(c.counts) != 0 {
+		t.Errorf("counts %v after releasing everything, want none", c.counts)
+	}
+
+	// a release too many doesn't make room for more than the cap
+	c.Acquire("alice")
+	if c.Acquire("alice") {
+		t.Error("acquired over the cap after an extra release")
+	}
+}
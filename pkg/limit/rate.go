@@ -0,0 +1,178 @@
+package limit
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// idle buckets are only swept once there are this many of them
+const sweepThreshold = 1000
+
+// Rate is a number of requests per period. The zero Rate means unlimited.
+type Rate struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseRate parses a rate written as <count>/<period>, like 10/1s, 100/m or 1000/1h. An empty string is unlimited.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Rate{}, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, errors.Errorf("rate %q should be written as <count>/<period>, like 10/1s", s)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count < 0 {
+		return Rate{}, errors.Errorf("rate %q should start with a number of requests", s)
+	}
+
+	period := strings.TrimSpace(parts[1])
+	if period != "" && strings.IndexAny(period[:1], "0123456789") < 0 {
+		period = "1" + period
+	}
+
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Rate{}, errors.Errorf("rate %q should end with a period, like 1s or 1m", s)
+	}
+
+	if count == 0 {
+		return Rate{}, nil
+	}
+
+	return Rate{Count: count, Period: d}, nil
+}
+
+// Unlimited is true for the zero Rate
+func (r Rate) Unlimited() bool {
+	return r.Count < 1 || r.Period <= 0
+}
+
+func (r Rate) String() string {
+	if r.Unlimited() {
+		return "unlimited"
+	}
+
+	return strconv.Itoa(r.Count) + "/" + r.Period.String()
+}
+
+// Limiter is a token bucket rate limiter with a bucket for every key. Every bucket holds up to Count tokens and is
+// refilled at Count tokens per Period, so bursts of up to Count requests are allowed.
+type Limiter struct {
+	lock    *sync.Mutex
+	rate    Rate
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a new instance of Limiter
+func NewLimiter(rate Rate) *Limiter {
+	return &Limiter{
+		lock:    &sync.Mutex{},
+		rate:    rate,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetRate changes the rate, keeping the tokens in the buckets
+func (l *Limiter) SetRate(rate Rate) {
+	l.lock.Lock()
+	l.rate = rate
+	l.lock.Unlock()
+}
+
+// Allow takes a token from the bucket for key. If there is none it returns false and how long it takes until there is.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate.Unlimited() {
+		return true, 0
+	}
+
+	b, perToken := l.refill(key)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * perToken)
+	}
+
+	b.tokens--
+
+	return true, 0
+}
+
+// Check is like Allow, but leaves the token in the bucket. It is used with Take when a request has to pass several
+// limiters, so that a request turned away by one of them doesn't use up tokens in the others.
+func (l *Limiter) Check(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate.Unlimited() {
+		return true, 0
+	}
+
+	b, perToken := l.refill(key)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * perToken)
+	}
+
+	return true, 0
+}
+
+// Take takes a token from the bucket for key after Check has found one. Requests that were checked at the same time
+// can take the bucket below zero, which then takes longer to fill up again.
+func (l *Limiter) Take(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate.Unlimited() {
+		return
+	}
+
+	b, _ := l.refill(key)
+	b.tokens--
+}
+
+// refill returns the bucket for key with the tokens it has gained since it was last used, and the time it takes to
+// gain a token
+func (l *Limiter) refill(key string) (*bucket, float64) {
+	now := time.Now()
+	perToken := float64(l.rate.Period) / float64(l.rate.Count)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= sweepThreshold {
+			l.sweep(now, perToken)
+		}
+
+		b = &bucket{tokens: float64(l.rate.Count), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.rate.Count), b.tokens+float64(now.Sub(b.last))/perToken)
+	b.last = now
+
+	return b, perToken
+}
+
+// sweep removes the buckets that have filled up again, since they are the same as a new bucket
+func (l *Limiter) sweep(now time.Time, perToken float64) {
+	for key, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))/perToken >= float64(l.rate.Count) {
+			delete(l.buckets, key)
+		}
+	}
+}
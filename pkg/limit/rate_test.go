@@ -0,0 +1,133 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Rate
+		ok   bool
+	}{
+		{"", Rate{}, true},
+		{"0", Rate{}, true},
+		{"0/1s", Rate{}, true},
+		{"10/1s", Rate{Count: 10, Period: time.Second}, true},
+		{"100/m", Rate{Count: 100, Period: time.Minute}, true},
+		{" 1000 / 1h ", Rate{Count: 1000, Period: time.Hour}, true},
+		{"5/30s", Rate{Count: 5, Period: 30 * time.Second}, true},
+		{"10", Rate{}, false},
+		{"ten/1s", Rate{}, false},
+		{"-1/1s", Rate{}, false},
+		{"10/", Rate{}, false},
+		{"10/0s", Rate{}, false},
+		{"10/fortnight", Rate{}, false},
+	}
+
+	for _, test := range tests {
+		rate, err := ParseRate(test.s)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("ParseRate(%q) error = %v, want ok %v", test.s, err, test.ok)
+			continue
+		}
+
+		if rate != test.want {
+			t.Errorf("ParseRate(%q) = %v, want %v", test.s, rate, test.want)
+		}
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l := NewLimiter(Rate{Count: 3, Period: time.Hour})
+
+	for i := 1; i <= 3; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatalf("request %d of the burst was refused", i)
+		}
+	}
+
+	ok, retryAfter := l.Allow("alice")
+	if ok {
+		t.Fatal("request after the burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > 20*time.Minute {
+		t.Errorf("retry after %s, want up to the time it takes to gain a token", retryAfter)
+	}
+
+	if ok, _ := l.Allow("bob"); !ok {
+		t.Error("another key shares the bucket")
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := NewLimiter(Rate{Count: 2, Period: time.Hour})
+
+	l.Allow("alice")
+	l.Allow("alice")
+
+	// half an hour gains one of the two tokens back
+	l.buckets["alice"].last = l.buckets["alice"].last.Add(-30 * time.Minute)
+	if ok, _ := l.Allow("alice"); !ok {
+		t.Fatal("refilled token was refused")
+	}
+	if ok, _ := l.Allow("alice"); ok {
+		t.Fatal("allowed more than was refilled")
+	}
+
+	// a long idle time fills the bucket up to its size and no further
+	l.buckets["alice"].last = l.buckets["alice"].last.Add(-24 * time.Hour)
+	for i := 1; i <= 2; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatalf("request %d after idling was refused", i)
+		}
+	}
+	if ok, _ := l.Allow("alice"); ok {
+		t.Error("bucket filled up past its size")
+	}
+}
+
+func TestLimiterCheckAndTake(t *testing.T) {
+	l := NewLimiter(Rate{Count: 1, Period: time.Hour})
+
+	for i := 1; i <= 3; i++ {
+		if ok, _ := l.Check("alice"); !ok {
+			t.Fatalf("check %d used up the token", i)
+		}
+	}
+
+	// requests that were checked at the same time both take, and the bucket goes below zero
+	l.Take("alice")
+	l.Take("alice")
+
+	ok, retryAfter := l.Check("alice")
+	if ok {
+		t.Fatal("check after taking the token was allowed")
+	}
+	if retryAfter <= time.Hour {
+		t.Errorf("retry after %s, want more than an hour for a bucket below zero", retryAfter)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := NewLimiter(Rate{})
+
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatal("unlimited limiter refused a request")
+		}
+		l.Take("alice")
+	}
+
+	if len(l.buckets) != 0 {
+		t.Errorf("unlimited limiter keeps %d buckets", len(l.buckets))
+	}
+
+	// changing the rate keeps the limiter, and starts limiting
+	l.SetRate(Rate{Count: 1, Period: time.Hour})
+	l.Allow("alice")
+	if ok, _ := l.Allow("alice"); ok {
+		t.Error("limiter is still unlimited after SetRate")
+	}
+}
@@ -0,0 +1,330 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets for request latencies, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is a metric that can write itself in the Prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics and serves them in the Prometheus text exposition format
+type Registry struct {
+	lock       *sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns a new instance of Registry without any metrics
+func NewRegistry() *Registry {
+	return &Registry{
+		lock:       &sync.Mutex{},
+		collectors: make([]collector, 0),
+	}
+}
+
+func (r *Registry) add(c collector) {
+	r.lock.Lock()
+	r.collectors = append(r.collectors, c)
+	r.lock.Unlock()
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, c := range collectors {
+		c.write(buf)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// CounterVec is a counter with a value for every combination of label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   *sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec adds a counter to the registry
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		lock:   &sync.Mutex{},
+		values: make(map[string]*series),
+	}
+	r.add(c)
+
+	return c
+}
+
+// Inc adds one to the counter for the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := c.values[key]
+	if !ok {
+		s = &series{labels: labelValues}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		s := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// GaugeVec is a gauge with a value for every combination of label values
+type GaugeVec struct {
+	CounterVec
+}
+
+// NewGaugeVec adds a gauge to the registry
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		CounterVec: CounterVec{
+			name:   name,
+			help:   help,
+			labels: labels,
+			lock:   &sync.Mutex{},
+			values: make(map[string]*series),
+		},
+	}
+	r.add(g)
+
+	return g
+}
+
+// Set sets the gauge for the label values
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := g.values[key]
+	if !ok {
+		s = &series{labels: labelValues}
+		g.values[key] = s
+	}
+	s.value = v
+}
+
+// Dec subtracts one from the gauge for the label values
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		s := g.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// GaugeFunc is a gauge that gets its value when the metrics are collected
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc adds a gauge to the registry whose value is returned by fn
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		name: name,
+		help: help,
+		fn:   fn,
+	}
+	r.add(g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+// HistogramVec counts observations, like request latencies, in buckets for every combination of label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    *sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec adds a histogram with the given upper bounds of its buckets to the registry
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: sorted,
+		lock:    &sync.Mutex{},
+		values:  make(map[string]*histogram),
+	}
+	r.add(h)
+
+	return h
+}
+
+// Observe adds an observation for the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		for i, upper := range h.buckets {
+			values := append(append([]string{}, s.labels...), formatValue(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.counts[i])
+		}
+		values := append(append([]string{}, s.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// seriesKey joins label values with a separator that can't be part of a valid UTF-8 label value
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch v := m.(type) {
+	case map[string]*series:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) < 1 {
+		return ""
+	}
+
+	escape := strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escape.Replace(value)))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,179 @@
+package policy
+
+import (
+	"io/ioutil"
+	"sync"
+
+	document "github.com/Brickchain/go-document.v2"
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Reasons for a request being denied
+const (
+	ReasonDenied        = "denied_by_rule"
+	ReasonNotAllowed    = "not_in_allow_list"
+	ReasonInvalidPolicy = "invalid_policy"
+	ReasonNoMandate     = "no_mandate"
+	ReasonEntity        = "entity_not_allowed"
+)
+
+// Decision is the outcome of checking a request against a policy
+type Decision struct {
+	Allowed bool   `json:"-"`
+	Reason  string `json:"reason,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Role    string `json:"role,omitempty"`
+}
+
+// RolePolicy is how the policy for a role is written in the policy file
+type RolePolicy struct {
+	Allow    []string `yaml:"allow" json:"allow"`
+	Deny     []string `yaml:"deny" json:"deny"`
+	Entities []string `yaml:"entities" json:"entities"`
+	Areas    []string `yaml:"areas" json:"areas"`
+}
+
+// Engine decides which requests the holders of a mandate are allowed to make, based on the policy in the mandate
+// parameters and the policy for the mandate role in the local policy file
+type Engine struct {
+	lock     *sync.RWMutex
+	roles    map[string]*Policy
+	resolver AreaResolver
+}
+
+// NewEngine returns a new instance of Engine without any role policies
+func NewEngine() *Engine {
+	return &Engine{
+		lock:  &sync.RWMutex{},
+		roles: make(map[string]*Policy),
+	}
+}
+
+// LoadFile reads the role policies from a YAML (or JSON) file, keyed by role, and replaces the current ones
+func (e *Engine) LoadFile(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read policy file")
+	}
+
+	file := make(map[string]RolePolicy)
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return errors.Wrap(err, "failed to parse policy file")
+	}
+
+	roles := make(map[string]*Policy)
+	for role, rp := range file {
+		p, err := NewPolicy(rp.Allow, rp.Deny)
+		if err != nil {
+			return errors.Wrapf(err, "invalid policy for role %s", role)
+		}
+		p.Entities = EntityFilter{
+			Entities: rp.Entities,
+			Areas:    rp.Areas,
+		}
+
+		roles[role] = p
+	}
+
+	e.lock.Lock()
+	e.roles = roles
+	e.lock.Unlock()
+
+	return nil
+}
+
+// Clear removes all role policies, like when the policy file is no longer used
+func (e *Engine) Clear() {
+	e.lock.Lock()
+	e.roles = make(map[string]*Policy)
+	e.lock.Unlock()
+}
+
+// rolePolicy returns the policy from the policy file for a role. Roles can be given either with the realm
+// (guest@realm.example) or without (guest), where the former takes precedence.
+func (e *Engine) rolePolicy(role string) *Policy {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if p, ok := e.roles[role]; ok {
+		return p
+	}
+
+	name, _ := document.RealmRoleParse(role)
+
+	return e.roles[name]
+}
+
+// roleFilter returns the entity filter from the policy file for a role
+func (e *Engine) roleFilter(role string) EntityFilter {
+	p := e.rolePolicy(role)
+	if p == nil {
+		return EntityFilter{}
+	}
+
+	return p.Entities
+}
+
+// Check decides if a request with the given method and path is allowed by any of the mandates
+func (e *Engine) Check(method, path string, mandates []httphandler.AuthenticatedMandate) Decision {
+	if len(mandates) < 1 {
+		return Decision{Reason: ReasonNoMandate}
+	}
+
+	var denied *Decision
+	for _, mandate := range mandates {
+		d := e.checkMandate(method, path, mandate.Mandate)
+		if d.Allowed {
+			return d
+		}
+
+		if denied == nil {
+			denied = &d
+		}
+	}
+
+	return *denied
+}
+
+// Permitting returns the mandates that allow a request with the given method and path on their own. The entity scope
+// of a request is taken from these, so that the path and the entities are allowed by the same mandate.
+func (e *Engine) Permitting(method, path string, mandates []httphandler.AuthenticatedMandate) []httphandler.AuthenticatedMandate {
+	permitting := make([]httphandler.AuthenticatedMandate, 0, len(mandates))
+	for _, mandate := range mandates {
+		if e.checkMandate(method, path, mandate.Mandate).Allowed {
+			permitting = append(permitting, mandate)
+		}
+	}
+
+	return permitting
+}
+
+// Restricted returns true if a mandate is limited by method and path rules, either from the policy file or from its
+// parameters. Requests that can't be checked against those rules, like commands on a websocket without a REST
+// equivalent, should be refused for it.
+func (e *Engine) Restricted(mandate httphandler.AuthenticatedMandate) bool {
+	paramPolicy, err := FromParams(mandate.Mandate.Params)
+	if err != nil {
+		return true
+	}
+
+	return !e.rolePolicy(mandate.Mandate.Role).Empty() || !paramPolicy.Empty()
+}
+
+func (e *Engine) checkMandate(method, path string, mandate *document.Mandate) Decision {
+	paramPolicy, err := FromParams(mandate.Params)
+	if err != nil {
+		return Decision{Reason: ReasonInvalidPolicy, Role: mandate.Role}
+	}
+
+	for _, p := range []*Policy{e.rolePolicy(mandate.Role), paramPolicy} {
+		if d := p.Check(method, path); !d.Allowed {
+			d.Role = mandate.Role
+			return d
+		}
+	}
+
+	return Decision{Allowed: true, Role: mandate.Role}
+}
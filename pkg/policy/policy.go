@@ -0,0 +1,181 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mandate parameters that carry a policy for the holder of the mandate
+const (
+	AllowParam = "allow"
+	DenyParam  = "deny"
+)
+
+// Rule matches requests on HTTP method and path, written as "METHOD /path". Several methods can be given separated
+// by "|", and "*" matches any method. A path ending in "*" matches anything that starts with the part before the
+// star, other paths match themselves and everything below them.
+type Rule struct {
+	Methods []string
+	Path    string
+	prefix  bool
+	raw     string
+}
+
+// ParseRule parses a rule from its "METHOD /path" form
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Rule{}, fmt.Errorf("rule %q should be written as \"METHOD /path\"", s)
+	}
+
+	if !strings.HasPrefix(fields[1], "/") {
+		return Rule{}, fmt.Errorf("path in rule %q should start with /", s)
+	}
+
+	rule := Rule{
+		Methods: strings.Split(strings.ToUpper(fields[0]), "|"),
+		Path:    fields[1],
+		raw:     strings.Join(fields, " "),
+	}
+
+	if strings.HasSuffix(rule.Path, "*") {
+		rule.Path = strings.TrimSuffix(rule.Path, "*")
+		rule.prefix = true
+	} else if rule.Path != "/" {
+		rule.Path = strings.TrimSuffix(rule.Path, "/")
+	}
+
+	return rule, nil
+}
+
+// String returns the rule in its "METHOD /path" form
+func (r Rule) String() string {
+	return r.raw
+}
+
+// Matches checks if the rule applies to a request with the given method and path
+func (r Rule) Matches(method, p string) bool {
+	methodMatch := false
+	for _, m := range r.Methods {
+		if m == "*" || m == strings.ToUpper(method) {
+			methodMatch = true
+			break
+		}
+	}
+
+	if !methodMatch {
+		return false
+	}
+
+	p = CleanPath(p)
+
+	if r.prefix {
+		return strings.HasPrefix(p, r.Path)
+	}
+
+	if r.Path == "/" || p == r.Path {
+		return true
+	}
+
+	return strings.HasPrefix(p, r.Path+"/")
+}
+
+// CleanPath normalizes a request path so that rules can't be sidestepped with "..", "." or repeated slashes
+func CleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return path.Clean(p)
+}
+
+// Policy is a set of allow and deny rules. Deny rules always win, and if there are any allow rules a request has to
+// match one of them. Entities further limits which Home Assistant entities can be accessed.
+type Policy struct {
+	Allow    []Rule
+	Deny     []Rule
+	Entities EntityFilter
+}
+
+// ParseRules parses a list of rules
+func ParseRules(rules []string) ([]Rule, error) {
+	parsed := make([]Rule, 0, len(rules))
+	for _, s := range rules {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+// NewPolicy parses the allow and deny rules into a Policy
+func NewPolicy(allow, deny []string) (*Policy, error) {
+	var err error
+	p := &Policy{}
+
+	if p.Allow, err = ParseRules(allow); err != nil {
+		return nil, errors.Wrap(err, "failed to parse allow rules")
+	}
+
+	if p.Deny, err = ParseRules(deny); err != nil {
+		return nil, errors.Wrap(err, "failed to parse deny rules")
+	}
+
+	return p, nil
+}
+
+// FromParams reads a policy from the comma separated allow and deny parameters of a mandate. It returns nil if the
+// mandate doesn't carry any policy.
+func FromParams(params map[string]string) (*Policy, error) {
+	allow, deny := params[AllowParam], params[DenyParam]
+	if allow == "" && deny == "" {
+		return nil, nil
+	}
+
+	return NewPolicy(strings.Split(allow, ","), strings.Split(deny, ","))
+}
+
+// Empty returns true if the policy doesn't have any allow or deny rules
+func (p *Policy) Empty() bool {
+	return p == nil || (len(p.Allow) < 1 && len(p.Deny) < 1)
+}
+
+// Check returns the decision of the policy for a request with the given method and path
+func (p *Policy) Check(method, path string) Decision {
+	if p.Empty() {
+		return Decision{Allowed: true}
+	}
+
+	for _, rule := range p.Deny {
+		if rule.Matches(method, path) {
+			return Decision{Reason: ReasonDenied, Rule: rule.String()}
+		}
+	}
+
+	if len(p.Allow) < 1 {
+		return Decision{Allowed: true}
+	}
+
+	for _, rule := range p.Allow {
+		if rule.Matches(method, path) {
+			return Decision{Allowed: true, Rule: rule.String()}
+		}
+	}
+
+	return Decision{Reason: ReasonNotAllowed}
+}
@@ -0,0 +1,180 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	document "github.com/Brickchain/go-document.v2"
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+)
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule   string
+		method string
+		path   string
+		match  bool
+	}{
+		{"GET /api/states", "GET", "/api/states", true},
+		{"GET /api/states", "get", "/api/states", true},
+		{"GET /api/states", "POST", "/api/states", false},
+		{"GET /api/states", "GET", "/api/states/light.kitchen", true},
+		{"GET /api/states", "GET", "/api/statesx", false},
+		{"GET /api/states/", "GET", "/api/states", true},
+		{"GET|POST /api/services", "POST", "/api/services/light/turn_on", true},
+		{"GET|POST /api/services", "DELETE", "/api/services/light/turn_on", false},
+		{"* /api", "DELETE", "/api/config", true},
+		{"* /", "GET", "/anything", true},
+		{"GET /api/camera_proxy*", "GET", "/api/camera_proxy_stream/camera.door", true},
+		{"GET /api/camera_proxy*", "GET", "/api/camera", false},
+		{"GET /api/states", "GET", "/api/config/../states", true},
+		{"GET /api/config", "GET", "/api/config/../states", false},
+		{"GET /api/states", "GET", "//api//states/./", true},
+		{"GET /api/states", "GET", "api/states", true},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRule(test.rule)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %s", test.rule, err)
+		}
+
+		if match := rule.Matches(test.method, test.path); match != test.match {
+			t.Errorf("%q matches %s %s = %v, want %v", test.rule, test.method, test.path, match, test.match)
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, s := range []string{"", "GET", "/api", "GET api", "GET /api extra"} {
+		if _, err := ParseRule(s); err == nil {
+			t.Errorf("ParseRule(%q) should fail", s)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		method  string
+		path    string
+		allowed bool
+		reason  string
+		rule    string
+	}{
+		{"empty policy allows", nil, nil, "GET", "/api/states", true, "", ""},
+		{"allow rule", []string{"GET /api/states"}, nil, "GET", "/api/states", true, "", "GET /api/states"},
+		{"not in allow list", []string{"GET /api/states"}, nil, "POST", "/api/services", false, ReasonNotAllowed, ""},
+		{"only deny rules", nil, []string{"POST /api/services"}, "GET", "/api/states", true, "", ""},
+		{"deny rule", nil, []string{"POST /api/services"}, "POST", "/api/services/lock/unlock", false, ReasonDenied, "POST /api/services"},
+		{"deny wins over allow", []string{"* /api"}, []string{"POST /api/services"}, "POST", "/api/services/lock/unlock", false, ReasonDenied, "POST /api/services"},
+		{"blank rules are skipped", []string{"", " "}, nil, "GET", "/api/states", true, "", ""},
+	}
+
+	for _, test := range tests {
+		p, err := NewPolicy(test.allow, test.deny)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		d := p.Check(test.method, test.path)
+		if d.Allowed != test.allowed || d.Reason != test.reason || d.Rule != test.rule {
+			t.Errorf("%s: got %+v, want allowed=%v reason=%q rule=%q", test.name, d, test.allowed, test.reason, test.rule)
+		}
+	}
+}
+
+func mandate(role string, params map[string]string) httphandler.AuthenticatedMandate {
+	return httphandler.AuthenticatedMandate{
+		Mandate: &document.Mandate{
+			Role:   role,
+			Params: params,
+		},
+	}
+}
+
+func TestEngineCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.yaml")
+	err = ioutil.WriteFile(file, []byte(`
+guest:
+  allow:
+    - GET /api/states
+admin@realm.example:
+  deny:
+    - POST /api/services/lock
+guest@other.example:
+  deny:
+    - "* /"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEngine()
+	if err := e.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		mandates []httphandler.AuthenticatedMandate
+		method   string
+		path     string
+		allowed  bool
+		reason   string
+		role     string
+	}{
+		{"no mandates", nil, "GET", "/api/states", false, ReasonNoMandate, ""},
+		{"role without realm", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", nil)}, "GET", "/api/states", true, "", "guest@realm.example"},
+		{"role without realm denies", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", nil)}, "POST", "/api/services/light/turn_on", false, ReasonNotAllowed, "guest@realm.example"},
+		{"role with realm takes precedence", []httphandler.AuthenticatedMandate{mandate("guest@other.example", nil)}, "GET", "/api/states", false, ReasonDenied, "guest@other.example"},
+		{"role with deny rule", []httphandler.AuthenticatedMandate{mandate("admin@realm.example", nil)}, "POST", "/api/services/lock/unlock", false, ReasonDenied, "admin@realm.example"},
+		{"role without policy", []httphandler.AuthenticatedMandate{mandate("other@realm.example", nil)}, "DELETE", "/api/config", true, "", "other@realm.example"},
+		{"params narrow the role", []httphandler.AuthenticatedMandate{mandate("admin@realm.example", map[string]string{AllowParam: "GET /api/states"})}, "POST", "/api/services/light/turn_on", false, ReasonNotAllowed, "admin@realm.example"},
+		{"params can't widen the role", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", map[string]string{AllowParam: "* /"})}, "POST", "/api/services/light/turn_on", false, ReasonNotAllowed, "guest@realm.example"},
+		{"invalid params", []httphandler.AuthenticatedMandate{mandate("admin@realm.example", map[string]string{DenyParam: "POST"})}, "GET", "/api/states", false, ReasonInvalidPolicy, "admin@realm.example"},
+		{"any mandate allows", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", nil), mandate("other@realm.example", nil)}, "POST", "/api/services/light/turn_on", true, "", "other@realm.example"},
+		{"first denial is reported", []httphandler.AuthenticatedMandate{mandate("guest@other.example", nil), mandate("guest@realm.example", nil)}, "POST", "/api/services/light/turn_on", false, ReasonDenied, "guest@other.example"},
+	}
+
+	for _, test := range tests {
+		d := e.Check(test.method, test.path, test.mandates)
+		if d.Allowed != test.allowed || d.Reason != test.reason || d.Role != test.role {
+			t.Errorf("%s: got %+v, want allowed=%v reason=%q role=%q", test.name, d, test.allowed, test.reason, test.role)
+		}
+	}
+}
+
+func TestEngineRestricted(t *testing.T) {
+	e := NewEngine()
+	e.roles["guest"] = &Policy{Deny: []Rule{mustParseRule(t, "POST /api/services/lock")}}
+	e.roles["viewer"] = &Policy{Entities: EntityFilter{Entities: []string{"light.*"}}}
+
+	tests := []struct {
+		name       string
+		mandate    httphandler.AuthenticatedMandate
+		restricted bool
+	}{
+		{"no rules", mandate("admin@realm.example", nil), false},
+		{"role rules", mandate("guest@realm.example", nil), true},
+		{"param rules", mandate("admin@realm.example", map[string]string{AllowParam: "GET /api/states"}), true},
+		{"invalid params", mandate("admin@realm.example", map[string]string{DenyParam: "POST"}), true},
+		{"only an entity scope", mandate("viewer@realm.example", nil), false},
+	}
+
+	for _, test := range tests {
+		if restricted := e.Restricted(test.mandate); restricted != test.restricted {
+			t.Errorf("%s: Restricted = %v, want %v", test.name, restricted, test.restricted)
+		}
+	}
+}
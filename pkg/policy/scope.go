@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"path"
+	"strings"
+
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/pkg/errors"
+)
+
+// Mandate parameters that limit which Home Assistant entities the holder of the mandate can see and control
+const (
+	EntitiesParam = "entities"
+	AreasParam    = "areas"
+)
+
+// AreaResolver looks up the entities that belong to a Home Assistant area
+type AreaResolver interface {
+	AreaEntities(area string) ([]string, error)
+}
+
+// EntityFilter limits access to entities matching one of the patterns (like light.*) or belonging to one of the areas
+type EntityFilter struct {
+	Entities []string
+	Areas    []string
+}
+
+// Empty returns true if the filter doesn't limit anything
+func (f EntityFilter) Empty() bool {
+	return len(f.Entities) < 1 && len(f.Areas) < 1
+}
+
+func filterFromParams(params map[string]string) EntityFilter {
+	return EntityFilter{
+		Entities: splitList(params[EntitiesParam]),
+		Areas:    splitList(params[AreasParam]),
+	}
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// Scope is the set of entities that a request is allowed to access. A nil Scope allows every entity.
+type Scope struct {
+	resolver AreaResolver
+	// every mandate contributes a list of filters that all have to match, and an entity is in scope if it is
+	// allowed by any of the mandates
+	mandates [][]EntityFilter
+}
+
+// Scope returns the entity scope of the mandates, or nil if any of them gives access to all entities. For a request it
+// should be given the mandates from Permitting, so that a mandate that doesn't allow the request can't widen the scope.
+func (e *Engine) Scope(mandates []httphandler.AuthenticatedMandate) *Scope {
+	e.lock.RLock()
+	resolver := e.resolver
+	e.lock.RUnlock()
+
+	scope := &Scope{
+		resolver: resolver,
+		mandates: make([][]EntityFilter, 0),
+	}
+
+	for _, mandate := range mandates {
+		filters := make([]EntityFilter, 0)
+
+		if f := e.roleFilter(mandate.Mandate.Role); !f.Empty() {
+			filters = append(filters, f)
+		}
+
+		if f := filterFromParams(mandate.Mandate.Params); !f.Empty() {
+			filters = append(filters, f)
+		}
+
+		if len(filters) < 1 {
+			return nil
+		}
+
+		scope.mandates = append(scope.mandates, filters)
+	}
+
+	return scope
+}
+
+// SetAreaResolver sets what is used to look up the entities in an area
+func (e *Engine) SetAreaResolver(resolver AreaResolver) {
+	e.lock.Lock()
+	e.resolver = resolver
+	e.lock.Unlock()
+}
+
+// Mandates returns the scope of every mandate on its own, for checks where all entities have to be allowed by the
+// same mandate, like the targets of a service call
+func (s *Scope) Mandates() []*Scope {
+	if s == nil {
+		return []*Scope{nil}
+	}
+
+	scopes := make([]*Scope, 0, len(s.mandates))
+	for _, filters := range s.mandates {
+		scopes = append(scopes, &Scope{
+			resolver: s.resolver,
+			mandates: [][]EntityFilter{filters},
+		})
+	}
+
+	return scopes
+}
+
+// Allows checks if an entity is in the scope
+func (s *Scope) Allows(entityID string) bool {
+	if s == nil {
+		return true
+	}
+
+	for _, filters := range s.mandates {
+		allowed := true
+		for _, f := range filters {
+			if !s.matches(f, entityID) {
+				allowed = false
+				break
+			}
+		}
+
+		if allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scope) matches(f EntityFilter, entityID string) bool {
+	for _, pattern := range f.Entities {
+		if ok, _ := path.Match(pattern, entityID); ok {
+			return true
+		}
+	}
+
+	if len(f.Areas) > 0 {
+		if s.resolver == nil {
+			logger.Warn("Mandate is limited to areas but there is no way to look up areas")
+			return false
+		}
+
+		for _, area := range f.Areas {
+			entities, err := s.resolver.AreaEntities(area)
+			if err != nil {
+				logger.Error(errors.Wrapf(err, "failed to look up entities in area %s", area))
+				continue
+			}
+
+			for _, id := range entities {
+				if id == entityID {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+)
+
+type areaMap map[string][]string
+
+func (a areaMap) AreaEntities(area string) ([]string, error) {
+	entities, ok := a[area]
+	if !ok {
+		return nil, errors.New("no such area")
+	}
+
+	return entities, nil
+}
+
+func TestScopeAllows(t *testing.T) {
+	e := NewEngine()
+	e.SetAreaResolver(areaMap{
+		"kitchen": {"light.kitchen", "switch.kettle"},
+	})
+	e.roles["guest"] = &Policy{Entities: EntityFilter{Entities: []string{"light.*", "switch.*"}}}
+
+	tests := []struct {
+		name     string
+		mandates []httphandler.AuthenticatedMandate
+		entity   string
+		allowed  bool
+	}{
+		{"unlimited mandate", []httphandler.AuthenticatedMandate{mandate("admin@realm.example", nil)}, "lock.front_door", true},
+		{"entity pattern", []httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{EntitiesParam: "light.*"})}, "light.hall", true},
+		{"entity pattern miss", []httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{EntitiesParam: "light.*"})}, "lock.front_door", false},
+		{"entity list with spaces", []httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{EntitiesParam: "lock.back_door, lock.front_door"})}, "lock.front_door", true},
+		{"area", []httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{AreasParam: "kitchen"})}, "switch.kettle", true},
+		{"area miss", []httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{AreasParam: "kitchen"})}, "light.hall", false},
+		{"unknown area", []httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{AreasParam: "attic"})}, "light.attic", false},
+		{"role and params both apply", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", map[string]string{AreasParam: "kitchen"})}, "switch.kettle", true},
+		{"role and params both apply miss", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", map[string]string{AreasParam: "kitchen"})}, "light.hall", false},
+		{"any mandate allows", []httphandler.AuthenticatedMandate{mandate("guest@realm.example", nil), mandate("user@realm.example", map[string]string{EntitiesParam: "lock.*"})}, "lock.front_door", true},
+	}
+
+	for _, test := range tests {
+		if allowed := e.Scope(test.mandates).Allows(test.entity); allowed != test.allowed {
+			t.Errorf("%s: Allows(%s) = %v, want %v", test.name, test.entity, allowed, test.allowed)
+		}
+	}
+}
+
+func TestScopeWithoutResolver(t *testing.T) {
+	e := NewEngine()
+	scope := e.Scope([]httphandler.AuthenticatedMandate{mandate("user@realm.example", map[string]string{AreasParam: "kitchen"})})
+
+	if scope.Allows("light.kitchen") {
+		t.Error("areas should not match anything without a resolver")
+	}
+}
+
+func TestPermittingScope(t *testing.T) {
+	e := NewEngine()
+	e.roles["viewer"] = &Policy{Allow: []Rule{mustParseRule(t, "GET /api/states")}}
+
+	viewer := mandate("viewer@realm.example", nil)
+	lights := mandate("user@realm.example", map[string]string{EntitiesParam: "light.*"})
+	switches := mandate("user@realm.example", map[string]string{EntitiesParam: "switch.*"})
+
+	tests := []struct {
+		name     string
+		mandates []httphandler.AuthenticatedMandate
+		method   string
+		path     string
+		entities []string
+		allowed  bool
+	}{
+		{"unlimited mandate that doesn't allow the path", []httphandler.AuthenticatedMandate{viewer, lights}, "POST", "/api/services/lock/unlock", []string{"lock.front_door"}, false},
+		{"limited mandate that allows the path", []httphandler.AuthenticatedMandate{viewer, lights}, "POST", "/api/services/light/turn_on", []string{"light.kitchen"}, true},
+		{"unlimited mandate that allows the path", []httphandler.AuthenticatedMandate{viewer, lights}, "GET", "/api/states/lock.front_door", []string{"lock.front_door"}, true},
+		{"entities from different mandates", []httphandler.AuthenticatedMandate{lights, switches}, "POST", "/api/services/homeassistant/turn_on", []string{"light.kitchen", "switch.kettle"}, false},
+		{"entities from one mandate", []httphandler.AuthenticatedMandate{lights, switches}, "POST", "/api/services/homeassistant/turn_on", []string{"switch.kettle", "switch.fan"}, true},
+	}
+
+	for _, test := range tests {
+		scope := e.Scope(e.Permitting(test.method, test.path, test.mandates))
+
+		allowed := false
+		for _, m := range scope.Mandates() {
+			all := true
+			for _, id := range test.entities {
+				if !m.Allows(id) {
+					all = false
+				}
+			}
+			allowed = allowed || all
+		}
+
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed = %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func mustParseRule(t *testing.T, s string) Rule {
+	rule, err := ParseRule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rule
+}
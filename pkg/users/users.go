@@ -0,0 +1,206 @@
+package users
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/pkg/errors"
+)
+
+// User ties realm users, either by the key that signs their mandate tokens or by a mandate param, to a Home Assistant
+// user. The refresh token is handed out by Home Assistant to ClientID when the user is added.
+type User struct {
+	Signer       string `json:"signer,omitempty"`
+	Param        string `json:"param,omitempty"`
+	Value        string `json:"value,omitempty"`
+	HAUser       string `json:"ha_user"`
+	ClientID     string `json:"client_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Matches checks if the user is the signer of a mandate token, or has the param in one of its mandates
+func (u User) Matches(signer string, params []map[string]string) bool {
+	if u.Signer != "" {
+		return strings.EqualFold(u.Signer, signer)
+	}
+
+	if u.Param == "" {
+		return false
+	}
+
+	for _, p := range params {
+		if value, ok := p[u.Param]; ok && value == u.Value {
+			return true
+		}
+	}
+
+	return false
+}
+
+type usersFile struct {
+	Users []User `json:"users"`
+}
+
+// Read reads the users from a file, a file that doesn't exist has no users
+func Read(file string) ([]User, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return []User{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read users file")
+	}
+
+	f := usersFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, errors.Wrap(err, "failed to parse users file")
+	}
+
+	for i, u := range f.Users {
+		if (u.Signer == "") == (u.Param == "") {
+			return nil, errors.Errorf("user %d in users file needs either a signer or a param", i+1)
+		}
+
+		if u.RefreshToken == "" || u.ClientID == "" {
+			return nil, errors.Errorf("user %d in users file has no refresh token", i+1)
+		}
+	}
+
+	return f.Users, nil
+}
+
+// Write writes the users to a file that only we can read, since it holds their refresh tokens
+func Write(file string, users []User) error {
+	b, err := json.MarshalIndent(usersFile{Users: users}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal users")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return errors.Wrap(err, "failed to create users file")
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write users file")
+	}
+	tmp.Close()
+
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to set users file permissions")
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to move users file into place")
+	}
+
+	return nil
+}
+
+// Map finds the Home Assistant user for realm users and keeps access tokens for them
+type Map struct {
+	lock     *sync.RWMutex
+	users    []User
+	auths    map[string]*hass.Auth
+	required bool
+}
+
+// NewMap returns a new instance of Map without any users
+func NewMap() *Map {
+	return &Map{
+		lock:  &sync.RWMutex{},
+		users: []User{},
+		auths: make(map[string]*hass.Auth),
+	}
+}
+
+// Load replaces the users with the ones in file. Access tokens are kept for the users that are still there.
+func (m *Map) Load(file string, client *hass.Client) error {
+	users, err := Read(file)
+	if err != nil {
+		return err
+	}
+
+	auths := make(map[string]*hass.Auth)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, u := range users {
+		if auth, ok := m.auths[u.RefreshToken]; ok {
+			auths[u.RefreshToken] = auth
+			continue
+		}
+
+		auths[u.RefreshToken] = hass.NewRefreshAuth(client, u.ClientID, u.RefreshToken)
+	}
+
+	m.users = users
+	m.auths = auths
+
+	return nil
+}
+
+// SetRequired sets if realm users that aren't mapped to a Home Assistant user are turned away
+func (m *Map) SetRequired(required bool) {
+	m.lock.Lock()
+	m.required = required
+	m.lock.Unlock()
+}
+
+// Required returns if realm users that aren't mapped to a Home Assistant user are turned away
+func (m *Map) Required() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.required
+}
+
+// Len returns the number of users
+func (m *Map) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.users)
+}
+
+// Lookup returns the first user that matches the signer of a mandate token or the params of its mandates
+func (m *Map) Lookup(signer string, params []map[string]string) (User, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, u := range m.users {
+		if u.Matches(signer, params) {
+			return u, true
+		}
+	}
+
+	return User{}, false
+}
+
+// Token returns a valid access token for a user
+func (m *Map) Token(u User) (string, error) {
+	m.lock.RLock()
+	auth, ok := m.auths[u.RefreshToken]
+	m.lock.RUnlock()
+
+	if !ok {
+		return "", errors.Errorf("no access for Home Assistant user %s", u.HAUser)
+	}
+
+	token, err := auth.Token(u.ClientID)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get access token for Home Assistant user %s", u.HAUser)
+	}
+
+	return token, nil
+}
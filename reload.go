@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	crypto "github.com/Brickchain/go-crypto.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+	"github.com/Brickchain/hass-proxy/pkg/controller"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/Brickchain/hass-proxy/pkg/policy"
+	"github.com/Brickchain/hass-proxy/pkg/users"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// settings that change how we register to the controller
+var credentialSettings = []string{"secret", "username", "password", "local", "local_host", "hassio_token"}
+
+// reloader applies changes to the config and policy files while running, without dropping the tunnel
+type reloader struct {
+	controller *controller.Controller
+	policies   *policy.Engine
+	tunnel     *tunnel
+	limits     *limits
+	users      *users.Map
+	watcher    *config.Watcher
+	lock       *sync.Mutex
+}
+
+func (r *reloader) reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous := make(map[string]string)
+	for _, setting := range credentialSettings {
+		previous[setting] = viper.GetString(setting)
+	}
+
+	problems, err := config.Reload()
+	if err != nil {
+		logger.Error(errors.Wrap(err, "failed to reload configuration, keeping the current one"))
+		return
+	}
+
+	for _, problem := range problems.Warnings() {
+		logger.Warn(problem)
+	}
+	if errs := problems.Errors(); len(errs) > 0 {
+		for _, problem := range errs {
+			logger.Error(problem)
+		}
+		logger.Error("Invalid configuration, keeping the current one")
+		return
+	}
+
+	setLogging()
+
+	if err := r.watcher.SetFiles(watchedFiles()); err != nil {
+		logger.Warn(err)
+	}
+
+	r.controller.SetClockSkew(viper.GetDuration("token_clock_skew"))
+	r.controller.SetPinnedKeys(viper.GetString("controller_key"), viper.GetString("realm_key"))
+
+	if err := loadPolicy(r.policies); err != nil {
+		logger.Error(err)
+	}
+
+	r.limits.configure()
+
+	if err := loadUsers(r.users); err != nil {
+		logger.Error(errors.Wrap(err, "failed to reload users, keeping the current ones"))
+	}
+
+	credentialsChanged := false
+	for _, setting := range credentialSettings {
+		if previous[setting] != viper.GetString(setting) {
+			credentialsChanged = true
+		}
+	}
+
+	if credentialsChanged {
+		credentials, err := newCredentials()
+		if err != nil {
+			logger.Error(err)
+		} else {
+			r.controller.SetCredentials(credentials)
+			r.controller.Refresh()
+		}
+	}
+
+	// a new key, like after rotate-key, is used by connecting to the proxy again
+	reconnect := false
+	key, err := readKey(viper.GetString("key"))
+	if err != nil {
+		logger.Error(errors.Wrap(err, "failed to read key, keeping the current one"))
+	} else if crypto.Thumbprint(key) != crypto.Thumbprint(r.tunnel.Key()) {
+		logger.Infof("Key changed to %s", crypto.Thumbprint(key))
+		reconnect = true
+	}
+
+	// moving to another proxy gives us a new hostname, and with that a new registration to the controller
+	endpoint := viper.GetString("proxy_endpoint")
+	if endpoint != r.tunnel.Endpoint() {
+		logger.Infof("Moving the tunnel to %s", endpoint)
+		reconnect = true
+	}
+
+	if reconnect {
+		previousKey := r.tunnel.Key()
+		if key != nil {
+			r.tunnel.SetKey(key)
+		}
+
+		if err := r.tunnel.Connect(endpoint, reconnectTimeout); err != nil {
+			r.tunnel.SetKey(previousKey)
+			logger.Error(errors.Wrap(err, "failed to reconnect the tunnel, keeping the current one"))
+		}
+	}
+
+	logger.Info("Reloaded configuration")
+}
+
+// watchedFiles returns the files to watch for changes, which are the config files, the key file and the users file
+func watchedFiles() []string {
+	return append(config.WatchedFiles(), viper.GetString("key"), config.UsersFile())
+}
+
+// authDebug is set when the reason a request is unauthorized is sent back in the response
+var authDebug int32
+
+// setLogging applies the logging and debug settings
+func setLogging() {
+	logger.SetLevel(viper.GetString("log_level"))
+	logger.SetFormatter(viper.GetString("log_formatter"))
+
+	var debug int32
+	if viper.GetBool("auth_debug") {
+		debug = 1
+	}
+	atomic.StoreInt32(&authDebug, debug)
+}
+
+// newCredentials returns what we authenticate to the controller with, either a secret, or an access token we get by
+// logging in to Home Assistant with a password
+func newCredentials() (controller.Credentials, error) {
+	switch {
+	case viper.GetString("secret") != "":
+		// split out the binding and secret parts of the secret environment variable
+		binding, secret, err := config.Secret()
+		if err != nil {
+			return nil, err
+		}
+
+		return controller.SecretCredentials{
+			Binding: binding,
+			Secret:  secret,
+		}, nil
+	case viper.GetString("password") != "":
+		return controller.TokenCredentials{
+			Source: newStoredLogin(newHassClient(), viper.GetString("username"), viper.GetString("password"), config.LoginFile()),
+		}, nil
+	default:
+		return nil, errors.New("You need to set a secret or a password!")
+	}
+}
+
+// loadPolicy sets up the access policy for the mandate roles from the policy file
+func loadPolicy(policies *policy.Engine) error {
+	policies.SetAreaResolver(newHassClient())
+
+	if viper.GetString("policy_file") == "" {
+		policies.Clear()
+		return nil
+	}
+
+	return policies.LoadFile(viper.GetString("policy_file"))
+}
+
+func newHassClient() *hass.Client {
+	return hass.NewClient(viper.GetString("local"), viper.GetString("local_host"), viper.GetString("hassio_token"))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/controller"
+)
+
+// errorResponse is the JSON body we send back when a request is not passed on to Home Assistant
+type errorResponse struct {
+	Error   string `json:"error"`
+	Reason  string `json:"reason,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeUnauthorized turns away a request without an accepted mandate token, telling why if auth_debug is set
+func writeUnauthorized(w http.ResponseWriter, result *controller.VerifyResult) {
+	if atomic.LoadInt32(&authDebug) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusUnauthorized, errorResponse{
+		Error:   "unauthorized",
+		Reason:  string(result.Reason),
+		Message: result.Message(),
+	})
+}
+
+// failure is why we couldn't get a response from Home Assistant, and how we tell the user about it
+type failure struct {
+	status     int
+	error      string
+	reason     string
+	message    string
+	retryAfter int
+}
+
+var (
+	failureUnreachable = failure{http.StatusBadGateway, "bad_gateway", "upstream_unreachable", "Home Assistant can't be reached", 30}
+	failureTimeout     = failure{http.StatusGatewayTimeout, "gateway_timeout", "upstream_timeout", "Home Assistant didn't respond in time", 10}
+	failureStarting    = failure{http.StatusServiceUnavailable, "service_unavailable", "upstream_starting", "Home Assistant is starting", 10}
+	failureInternal    = failure{http.StatusInternalServerError, "internal_error", "proxy_error", "The request couldn't be passed on to Home Assistant", 0}
+	failureTooLarge    = failure{http.StatusBadGateway, "bad_gateway", "response_too_large", "The response from Home Assistant is too large to pass through the tunnel", 0}
+	failureShutdown    = failure{http.StatusServiceUnavailable, "service_unavailable", "shutting_down", "The tunnel is shutting down", 10}
+	// the retry time of these is set from the limit that was hit
+	failureRateLimited     = failure{http.StatusTooManyRequests, "too_many_requests", "rate_limited", "Too many requests, please slow down", 1}
+	failureTooManyFailures = failure{http.StatusTooManyRequests, "too_many_requests", "too_many_failed_attempts", "Too many requests that could not be authorized", 1}
+	failureConcurrency     = failure{http.StatusTooManyRequests, "too_many_requests", "too_many_concurrent", "Too many requests at the same time", 1}
+)
+
+// failureHTML is the page browsers get instead of the JSON error body. It reloads itself when it is time to retry.
+const failureHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+%s<title>%s</title>
+<style>body{font-family:sans-serif;text-align:center;margin-top:20vh;color:#333}</style>
+</head>
+<body>
+<h1>%s</h1>
+<p>%s</p>
+</body>
+</html>
+`
+
+// writeFailure tells the user why their request couldn't be served, with a JSON body or, for browsers, an HTML page
+func writeFailure(w http.ResponseWriter, r *http.Request, f failure) {
+	hint := "Please try again later."
+	refresh := ""
+	if f.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(f.retryAfter))
+		hint = fmt.Sprintf("This page will try again in %d seconds.", f.retryAfter)
+		refresh = fmt.Sprintf("<meta http-equiv=\"refresh\" content=\"%d\">\n", f.retryAfter)
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeJSON(w, f.status, errorResponse{
+			Error:   f.error,
+			Reason:  f.reason,
+			Message: f.message,
+		})
+		return
+	}
+
+	message := html.EscapeString(f.message)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(f.status)
+	fmt.Fprintf(w, failureHTML, refresh, message, message, html.EscapeString(hint))
+}
+
+// upstreamFailure tells why a request to Home Assistant failed. Anything but a timeout, like a refused connection,
+// means that Home Assistant can't be reached.
+func upstreamFailure(err error, idle *idleTimer) failure {
+	if idle != nil && idle.expired() {
+		return failureTimeout
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return failureTimeout
+	}
+
+	return failureUnreachable
+}
+
+// upstreamStarting checks if a response comes from a proxy in front of Home Assistant, like the Supervisor, that
+// answers for it while Home Assistant isn't up. Errors from Home Assistant itself come as JSON and are passed on.
+func upstreamStarting(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	return mediaType != "application/json"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/Brickchain/hass-proxy/pkg/policy"
+	"github.com/pkg/errors"
+)
+
+// the largest service call body we read in order to check which entities it targets
+const maxServiceBody = 1 << 20
+
+// checkEntityScope checks that a request only touches entities in the scope of its mandates, and writes a 403 if it
+// doesn't. API endpoints that can't be checked against the scope are denied. The body of service calls is read and put
+// back on the request.
+func checkEntityScope(w http.ResponseWriter, r *http.Request, scope *policy.Scope) bool {
+	path := policy.CleanPath(r.URL.Path)
+
+	if !hass.ScopeCheckable(r.Method, path) {
+		writeJSON(w, http.StatusForbidden, errorResponse{
+			Error:  "forbidden",
+			Reason: policy.ReasonEntity,
+		})
+		return false
+	}
+
+	if id, ok := hass.EntityFromPath(path); ok && !scope.Allows(id) {
+		writeJSON(w, http.StatusForbidden, errorResponse{
+			Error:  "forbidden",
+			Reason: policy.ReasonEntity,
+		})
+		return false
+	}
+
+	if hass.IsServiceCall(r.Method, path) {
+		body, ok := readServiceBody(w, r)
+		if !ok {
+			return false
+		}
+
+		if !serviceBodyAllowed(body, scope) {
+			writeJSON(w, http.StatusForbidden, errorResponse{
+				Error:  "forbidden",
+				Reason: policy.ReasonEntity,
+			})
+			return false
+		}
+	}
+
+	return true
+}
+
+// serviceBodyAllowed checks that all the entities a service call targets are allowed by one of the mandates
+func serviceBodyAllowed(body []byte, scope *policy.Scope) bool {
+	for _, mandate := range scope.Mandates() {
+		if hass.ServiceBodyAllowed(body, mandate.Allows) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readServiceBody reads the body of a service call and puts it back on the request, or writes a 413 if it is too large
+func readServiceBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxServiceBody))
+		if err != nil {
+			logger.Error(errors.Wrap(err, "failed to read service call body"))
+			writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse{Error: "request too large"})
+			return nil, false
+		}
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return body, true
+}
+
+// writeFilteredStates writes a state list response from Home Assistant, leaving out entities outside of the scope
+func writeFilteredStates(w http.ResponseWriter, res *http.Response, body []byte, scope *policy.Scope) {
+	filtered, err := hass.FilterStates(body, scope.Allows)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(filtered)))
+	w.WriteHeader(res.StatusCode)
+	w.Write(filtered)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drainer keeps track of the requests and websocket sessions that are being served, so that they can finish before we
+// shut down
+type drainer struct {
+	lock     *sync.Mutex
+	wg       *sync.WaitGroup
+	closing  bool
+	abort    chan struct{}
+	sessions map[*wsSession]bool
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		lock:     &sync.Mutex{},
+		wg:       &sync.WaitGroup{},
+		abort:    make(chan struct{}),
+		sessions: make(map[*wsSession]bool),
+	}
+}
+
+// begin registers a request that is being served. It returns false if we are shutting down, in which case the request
+// should be turned away.
+func (d *drainer) begin() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closing {
+		return false
+	}
+
+	d.wg.Add(1)
+
+	return true
+}
+
+// end marks a request registered with begin as done
+func (d *drainer) end() {
+	d.wg.Done()
+}
+
+// aborted is closed when requests that are still running when the shutdown deadline passes should be aborted
+func (d *drainer) aborted() <-chan struct{} {
+	return d.abort
+}
+
+func (d *drainer) addSession(s *wsSession) {
+	d.lock.Lock()
+	d.sessions[s] = true
+	d.lock.Unlock()
+}
+
+func (d *drainer) removeSession(s *wsSession) {
+	d.lock.Lock()
+	delete(d.sessions, s)
+	d.lock.Unlock()
+}
+
+// Drain turns away new requests, asks the websocket sessions to close and waits for everything to finish. Whatever is
+// still running when timeout passes is aborted. It returns false if anything had to be aborted.
+func (d *drainer) Drain(timeout time.Duration) bool {
+	d.lock.Lock()
+	d.closing = true
+	sessions := make([]*wsSession, 0, len(d.sessions))
+	for s := range d.sessions {
+		sessions = append(sessions, s)
+	}
+	d.lock.Unlock()
+
+	for _, s := range sessions {
+		s.goingAway()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+	}
+
+	close(d.abort)
+
+	d.lock.Lock()
+	for s := range d.sessions {
+		s.close()
+	}
+	d.lock.Unlock()
+
+	// give the aborted requests a moment to clean up
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+	}
+
+	return false
+}
+
+// wsSession is a websocket connection that is being relayed between the client and Home Assistant
+type wsSession struct {
+	up   *wsWriter
+	down *wsWriter
+}
+
+// goingAway asks both sides to close the connection
+func (s *wsSession) goingAway() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy is shutting down")
+	for _, w := range []*wsWriter{s.down, s.up} {
+		_ = w.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+}
+
+// close closes both connections without waiting for the other sides
+func (s *wsSession) close() {
+	s.down.conn.Close()
+	s.up.conn.Close()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/go-proxy.v1/pkg/client"
+	"github.com/Brickchain/hass-proxy/pkg/controller"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v1"
+)
+
+// tunnel keeps our connection to the proxy, which can be moved to another proxy endpoint while running
+type tunnel struct {
+	key        *jose.JsonWebKey
+	handler    http.Handler
+	controller *controller.Controller
+	lock       *sync.Mutex
+	endpoint   string
+	client     *client.ProxyClient
+}
+
+func newTunnel(key *jose.JsonWebKey, handler http.Handler, controller *controller.Controller) *tunnel {
+	return &tunnel{
+		key:        key,
+		handler:    handler,
+		controller: controller,
+		lock:       &sync.Mutex{},
+	}
+}
+
+// SetKey sets the key we register to the proxy with, which is used from the next time we connect
+func (t *tunnel) SetKey(key *jose.JsonWebKey) {
+	t.lock.Lock()
+	t.key = key
+	t.lock.Unlock()
+}
+
+// Key returns the key we register to the proxy with
+func (t *tunnel) Key() *jose.JsonWebKey {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.key
+}
+
+// how long we wait for a new proxy to register us while the tunnel is already up, before keeping the current one
+const reconnectTimeout = time.Minute
+
+// Connect registers to the proxy at endpoint and starts serving requests from it. If we are already connected to
+// another endpoint, that connection is only closed once the new one is up, and is kept if the new one fails. The
+// proxy client keeps trying to reach the proxy until it can, so with a timeout we give up after that long and
+// disconnect the new client, otherwise we wait for as long as it takes.
+func (t *tunnel) Connect(endpoint string, timeout time.Duration) error {
+	p, err := client.NewProxyClient(endpoint)
+	if err != nil {
+		return errors.Wrap(err, "failed to create proxy client")
+	}
+
+	hostname, err := registerWithin(p, t.Key(), timeout)
+	if err != nil {
+		if err := p.Disconnect(); err != nil {
+			logger.Debug(errors.Wrap(err, "failed to disconnect the new proxy client"))
+		}
+
+		return err
+	}
+
+	logger.Infof("Got hostname: %s", hostname)
+
+	// only accept mandate tokens that are issued for our hostname, this also registers to the controller again if
+	// the hostname changed
+	t.controller.SetAudience(hostname)
+
+	p.SetHandler(&tunnelHandler{tunnel: t, client: p})
+
+	t.lock.Lock()
+	old := t.client
+	t.client = p
+	t.endpoint = endpoint
+	t.lock.Unlock()
+
+	tunnelConnected.Set(1)
+
+	if old != nil {
+		tunnelReconnects.Inc("reconnected")
+		if err := old.Disconnect(); err != nil {
+			logger.Warn(errors.Wrap(err, "failed to disconnect from the previous proxy"))
+		}
+	}
+
+	return nil
+}
+
+// registerWithin registers the proxy client with our key, giving up once the timeout has passed if there is one
+func registerWithin(p *client.ProxyClient, key *jose.JsonWebKey, timeout time.Duration) (string, error) {
+	type result struct {
+		hostname string
+		err      error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		hostname, err := p.Register(key)
+		done <- result{hostname: hostname, err: err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return "", errors.Wrap(res.err, "failed to register to the proxy")
+		}
+
+		return res.hostname, nil
+	case <-expired:
+		return "", errors.Errorf("the proxy did not register us within %s", timeout)
+	}
+}
+
+// tunnelHandler passes the requests from one proxy client on to the handler of the tunnel
+type tunnelHandler struct {
+	tunnel *tunnel
+	client *client.ProxyClient
+}
+
+func (h *tunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.tunnel.watchHostname(h.client, r)
+	h.tunnel.handler.ServeHTTP(w, r)
+}
+
+// watchHostname follows the hostname that the proxy client sets as the URL host of every request. The client registers
+// to the proxy again by itself when it reconnects, and can get a new hostname then without telling us, so this is where
+// we find out, also from the pings and health checks of the proxy. Requests from a client that has been replaced are
+// left out, so that they can't move us back to its hostname.
+func (t *tunnel) watchHostname(p *client.ProxyClient, r *http.Request) {
+	if r.URL.Host == "" || websocket.IsWebSocketUpgrade(r) {
+		return
+	}
+
+	t.lock.Lock()
+	current := t.client == p
+	t.lock.Unlock()
+
+	if !current {
+		return
+	}
+
+	if audience := t.controller.Audience(); audience != "" && audience != r.URL.Host {
+		tunnelReconnects.Inc("new_hostname")
+	}
+	t.controller.SetAudience(r.URL.Host)
+}
+
+// Endpoint returns the proxy endpoint we are connected to
+func (t *tunnel) Endpoint() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.endpoint
+}
+
+// Wait blocks until the connection to the proxy ends without having been replaced by a new one, or until we disconnect
+func (t *tunnel) Wait() {
+	for {
+		t.lock.Lock()
+		p := t.client
+		t.lock.Unlock()
+
+		if p == nil {
+			return
+		}
+
+		p.Wait()
+
+		t.lock.Lock()
+		replaced := t.client != nil && t.client != p
+		t.lock.Unlock()
+
+		if !replaced {
+			return
+		}
+	}
+}
+
+// Disconnect tells the proxy that we are going away and closes the connection to it
+func (t *tunnel) Disconnect() error {
+	t.lock.Lock()
+	p := t.client
+	t.client = nil
+	t.lock.Unlock()
+
+	tunnelConnected.Set(0)
+
+	if p == nil {
+		return nil
+	}
+
+	return p.Disconnect()
+}
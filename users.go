@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/Brickchain/hass-proxy/pkg/users"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// the client ID that refresh tokens for mapped users are handed out to, which Home Assistant shows in the user profile
+const usersClientID = "https://github.com/Brickchain/hass-proxy/"
+
+// failureUserToken is returned when we can't get an access token for the Home Assistant user of the caller
+var failureUserToken = failure{http.StatusBadGateway, "bad_gateway", "user_token", "Could not log in to Home Assistant as your user", 30}
+
+// userToken returns the access token of the Home Assistant user the caller is mapped to, or an empty string if the
+// caller isn't mapped and requests should be made with hassio_token. It returns false if the request can't be
+// served, after writing why.
+func (h *httpClient) userToken(w http.ResponseWriter, r *http.Request, signer string, mandates []httphandler.AuthenticatedMandate) (string, bool) {
+	params := make([]map[string]string, 0, len(mandates))
+	for _, mandate := range mandates {
+		params = append(params, mandate.Mandate.Params)
+	}
+
+	user, ok := h.users.Lookup(signer, params)
+	if !ok {
+		if h.users.Required() {
+			writeJSON(w, http.StatusForbidden, errorResponse{
+				Error:  "forbidden",
+				Reason: "no_user",
+			})
+			return "", false
+		}
+
+		return "", true
+	}
+
+	token, err := h.users.Token(user)
+	if err != nil {
+		logger.Error(err)
+		writeFailure(w, r, failureUserToken)
+		return "", false
+	}
+
+	return token, true
+}
+
+// loadUsers loads the Home Assistant users that realm users are mapped to
+func loadUsers(m *users.Map) error {
+	if err := m.Load(config.UsersFile(), newHassClient()); err != nil {
+		return err
+	}
+	m.SetRequired(viper.GetBool("users_required"))
+
+	if m.Len() > 0 {
+		logger.Infof("Loaded %d Home Assistant user(s) from %s", m.Len(), config.UsersFile())
+	}
+
+	return nil
+}
+
+// addUser logs in to Home Assistant as a user, and maps a realm user to it with the refresh token it gets back
+func addUser(args []string) int {
+	fs := newFlagSet("add-user")
+	signer := fs.String("signer", "", "thumbprint of the key that the realm user signs mandate tokens with")
+	param := fs.String("param", "", "mandate param that identifies the realm user, as <name>=<value>")
+	haUser := fs.String("ha-username", "", "Home Assistant username")
+	passwordFile := fs.String("ha-password-file", "", "file with the Home Assistant password, it is asked for if not set")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	if (*signer == "") == (*param == "") || *haUser == "" {
+		fmt.Fprintf(os.Stderr, "Usage: hass-proxy add-user --ha-username <username> (--signer <thumbprint> | --param <name>=<value>)\n")
+		return 2
+	}
+
+	user := users.User{
+		Signer:   strings.ToLower(*signer),
+		HAUser:   *haUser,
+		ClientID: usersClientID,
+	}
+
+	if *param != "" {
+		parts := strings.SplitN(*param, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			fmt.Fprintf(os.Stderr, "error: --param should be written as <name>=<value>\n")
+			return 2
+		}
+		user.Param, user.Value = parts[0], parts[1]
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	auth := hass.NewAuth(newHassClient(), user.HAUser, password)
+	if _, err := auth.Token(user.ClientID); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	user.RefreshToken = auth.RefreshToken()
+
+	file := config.UsersFile()
+	list, err := users.Read(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	// a realm user is mapped to a single Home Assistant user
+	kept := make([]users.User, 0, len(list)+1)
+	for _, u := range list {
+		if u.Signer != user.Signer || u.Param != user.Param || u.Value != user.Value {
+			kept = append(kept, u)
+		}
+	}
+	kept = append(kept, user)
+
+	if err := users.Write(file, kept); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Mapped %s to Home Assistant user %s\n", describeUser(user), user.HAUser)
+
+	return 0
+}
+
+// listUsers prints the realm users and the Home Assistant users they are mapped to
+func listUsers(args []string) int {
+	if status, ok := parseFlags(newFlagSet("list-users"), args); !ok {
+		return status
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	list, err := users.Read(config.UsersFile())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	for _, u := range list {
+		fmt.Printf("%s -> %s\n", describeUser(u), u.HAUser)
+	}
+
+	return 0
+}
+
+// removeUser removes the mapping of a realm user. The refresh token stays valid until it is revoked in the profile of
+// the Home Assistant user.
+func removeUser(args []string) int {
+	fs := newFlagSet("remove-user")
+	signer := fs.String("signer", "", "thumbprint of the key that the realm user signs mandate tokens with")
+	param := fs.String("param", "", "mandate param that identifies the realm user, as <name>=<value>")
+	if status, ok := parseFlags(fs, args); !ok {
+		return status
+	}
+
+	if (*signer == "") == (*param == "") {
+		fmt.Fprintf(os.Stderr, "Usage: hass-proxy remove-user (--signer <thumbprint> | --param <name>=<value>)\n")
+		return 2
+	}
+
+	if !loadConfig() {
+		return 1
+	}
+
+	file := config.UsersFile()
+	list, err := users.Read(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	kept := make([]users.User, 0, len(list))
+	for _, u := range list {
+		if *signer != "" && strings.EqualFold(u.Signer, *signer) {
+			continue
+		}
+		if *param != "" && u.Param+"="+u.Value == *param {
+			continue
+		}
+		kept = append(kept, u)
+	}
+
+	if len(kept) == len(list) {
+		fmt.Fprintf(os.Stderr, "error: no such user\n")
+		return 1
+	}
+
+	if err := users.Write(file, kept); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+
+	fmt.Println("Removed user, revoke the refresh token in the Home Assistant profile of the user to stop it for good")
+
+	return 0
+}
+
+func describeUser(u users.User) string {
+	if u.Signer != "" {
+		return "signer " + u.Signer
+	}
+
+	return fmt.Sprintf("param %s=%s", u.Param, u.Value)
+}
+
+// readPassword reads a password from a file, or asks for it on the terminal
+func readPassword(file string) (string, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Home Assistant password: ")
+		b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+
+		return string(b), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	httphandler "github.com/Brickchain/go-httphandler.v2"
+	logger "github.com/Brickchain/go-logger.v1"
+	"github.com/Brickchain/hass-proxy/pkg/audit"
+	"github.com/Brickchain/hass-proxy/pkg/config"
+	"github.com/Brickchain/hass-proxy/pkg/hass"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// headers that are handled by the websocket libraries and should not be copied to the upstream handshake
+var websocketHandshakeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	// the origin is the remote user, the request has already been authorized by its mandate token
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// serveWebSocket dials the Home Assistant websocket endpoint, upgrades the tunneled request and relays frames between
+// the two connections until one of them goes away. If the mandates that allow the websocket are limited by path rules
+// or to some entities, the commands are checked against them and the messages are filtered to their scope.
+func (h *httpClient) serveWebSocket(w http.ResponseWriter, r *http.Request, permitting,
+	mandates []httphandler.AuthenticatedMandate, userToken string, record *audit.Record) {
+	u, err := localURL(r)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "failed to parse local url"))
+		writeFailure(w, r, failureInternal)
+		return
+	}
+
+	host := localHost(u)
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+
+	headers := http.Header{}
+	copyHeader(headers, r.Header)
+	for _, k := range websocketHandshakeHeaders {
+		headers.Del(k)
+	}
+	removeHopHeaders(headers)
+	headers.Del("Authorization")
+	setForwardedHeaders(headers, h.controller.Audience())
+	headers.Set("Host", host)
+
+	settings := config.CurrentUpstream()
+	setIdentityHeaders(headers, r, settings, mandates)
+
+	if userToken != "" {
+		headers.Set("Authorization", "Bearer "+userToken)
+	} else if settings.Token != "" {
+		headers.Set("X-HA-ACCESS", settings.Token)
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     websocket.Subprotocols(r),
+	}
+
+	upstream, res, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "failed to dial upstream websocket"))
+		switch {
+		case res != nil && upstreamStarting(res):
+			upstreamErrors.Inc(failureStarting.reason)
+			writeFailure(w, r, failureStarting)
+		case res != nil:
+			w.WriteHeader(res.StatusCode)
+		default:
+			f := upstreamFailure(err, nil)
+			upstreamErrors.Inc(f.reason)
+			writeFailure(w, r, f)
+		}
+		return
+	}
+	defer upstream.Close()
+
+	responseHeader := http.Header{}
+	if protocol := upstream.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+
+	downstream, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "failed to upgrade websocket"))
+		return
+	}
+	defer downstream.Close()
+
+	logger.Debugf("Websocket opened for %s", r.URL.Path)
+
+	forwardControl(downstream, upstream)
+	forwardControl(upstream, downstream)
+
+	up := &wsWriter{conn: upstream, lock: &sync.Mutex{}}
+	down := &wsWriter{conn: downstream, lock: &sync.Mutex{}}
+
+	// let the session be closed if we shut down
+	session := &wsSession{up: up, down: down}
+	h.drain.addSession(session)
+	defer h.drain.removeSession(session)
+
+	websocketSessions.Add(1)
+	defer websocketSessions.Dec()
+
+	var toUpstream, toDownstream wsFilterFunc
+
+	// authenticate the session as the Home Assistant user the caller is mapped to
+	if userToken != "" {
+		toUpstream = func(msg []byte) []byte {
+			return hass.SetAuthToken(msg, userToken)
+		}
+	}
+
+	if authorize := h.websocketAuthorizer(permitting); authorize != nil {
+		filter := hass.NewWebSocketFilter(authorize)
+		setAuth := toUpstream
+		toUpstream = func(msg []byte) []byte {
+			if setAuth != nil {
+				msg = setAuth(msg)
+			}
+
+			forward, reply := filter.FromClient(msg)
+			if reply != nil {
+				if err := down.write(websocket.TextMessage, reply); err != nil {
+					logger.Debug(errors.Wrap(err, "failed to reply to websocket message"))
+				}
+			}
+
+			return forward
+		}
+		toDownstream = filter.FromServer
+	}
+
+	// every service call is written to the audit log, like the REST service calls are
+	if h.audit != nil {
+		relay := toUpstream
+		toUpstream = func(msg []byte) []byte {
+			forward := msg
+			if relay != nil {
+				forward = relay(msg)
+			}
+
+			h.auditCommand(record, msg, forward != nil)
+
+			return forward
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go relayWebSocket(up, downstream, toUpstream, done)
+	go relayWebSocket(down, upstream, toDownstream, done)
+
+	// when one direction stops we tear down both connections so that the other direction stops as well
+	<-done
+	downstream.Close()
+	upstream.Close()
+	<-done
+
+	logger.Debugf("Websocket closed for %s", r.URL.Path)
+}
+
+// websocketAuthorizer returns what decides if a websocket command is allowed by the mandates, or nil if one of them
+// allows everything. Commands are checked as the REST request they do the same as against the path rules, and commands
+// without one are refused for mandates that have path rules. The command and its entities have to be allowed by the
+// same mandate.
+func (h *httpClient) websocketAuthorizer(mandates []httphandler.AuthenticatedMandate) hass.CommandFunc {
+	for _, mandate := range mandates {
+		if !h.policy.Restricted(mandate) && h.policy.Scope([]httphandler.AuthenticatedMandate{mandate}) == nil {
+			return nil
+		}
+	}
+
+	return func(cmd hass.Command) (hass.EntityFunc, bool) {
+		for _, mandate := range mandates {
+			single := []httphandler.AuthenticatedMandate{mandate}
+
+			if h.policy.Restricted(mandate) {
+				method, path, ok := hass.CommandRequest(cmd)
+				if !ok || !h.policy.Check(method, path, single).Allowed {
+					continue
+				}
+			}
+
+			scope := h.policy.Scope(single)
+			if scope == nil {
+				return nil, true
+			}
+
+			if hass.CommandInScope(cmd, scope.Allows) {
+				return scope.Allows, true
+			}
+		}
+
+		return nil, false
+	}
+}
+
+// wsFilterFunc inspects a text or binary message and returns what should be relayed, or nil to drop it
+type wsFilterFunc func(msg []byte) []byte
+
+// wsWriter serializes writes to a websocket connection, since messages can be written by both relay directions
+type wsWriter struct {
+	conn *websocket.Conn
+	lock *sync.Mutex
+}
+
+func (w *wsWriter) write(typ int, msg []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.conn.WriteMessage(typ, msg)
+}
+
+// relayWebSocket copies text and binary messages from src to dst, passing text messages through the filter if there
+// is one. When src is closed the close frame is passed on to dst before returning.
+func relayWebSocket(dst *wsWriter, src *websocket.Conn, filter wsFilterFunc, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	for {
+		typ, msg, err := src.ReadMessage()
+		if err != nil {
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			if e, ok := err.(*websocket.CloseError); ok {
+				switch e.Code {
+				case websocket.CloseNoStatusReceived:
+					closeMsg = websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				case websocket.CloseAbnormalClosure:
+				default:
+					closeMsg = websocket.FormatCloseMessage(e.Code, e.Text)
+				}
+			}
+			_ = dst.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+
+			return
+		}
+
+		// binary messages go through the filter as well, so that a scoped session can't use them to get around it
+		if filter != nil && (typ == websocket.TextMessage || typ == websocket.BinaryMessage) {
+			if msg = filter(msg); msg == nil {
+				continue
+			}
+		}
+
+		if err := dst.write(typ, msg); err != nil {
+			logger.Debug(errors.Wrap(err, "failed to relay websocket message"))
+			return
+		}
+	}
+}
+
+// forwardControl passes ping and pong frames received on src on to dst, so keepalives work end to end
+func forwardControl(dst, src *websocket.Conn) {
+	src.SetPingHandler(func(data string) error {
+		return dst.WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	src.SetPongHandler(func(data string) error {
+		return dst.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+}